@@ -0,0 +1,219 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"fmt"
+	"strings"
+)
+
+// URLs returns every 856 $u in the record, across all instances, as is.
+func (m *MarcRecord) URLs() []string {
+	urls := make([]string, 0)
+	field := m.GetRawField("856")
+	for i := 0; i < field.ValueCount(); i++ {
+		urls = append(urls, field.subfieldValues("u", i)...)
+	}
+	return urls
+}
+
+// LCClassification returns the Library of Congress call number from each
+// 050, its classification number ($a) and item number ($b) joined by a
+// space.
+func (m *MarcRecord) LCClassification() []string {
+	numbers := make([]string, 0)
+	field := m.GetRawField("050")
+	for i := 0; i < field.ValueCount(); i++ {
+		parts := make([]string, 0, 2)
+		for _, code := range []string{"a", "b"} {
+			if v := strings.TrimSpace(field.GetNthSubfield(code, i)); v != "" {
+				parts = append(parts, v)
+			}
+		}
+		if len(parts) > 0 {
+			numbers = append(numbers, strings.Join(parts, " "))
+		}
+	}
+	return numbers
+}
+
+// DeweyClassification returns every Dewey Decimal classification number
+// (082 $a) in the record.
+func (m *MarcRecord) DeweyClassification() []string {
+	numbers := make([]string, 0)
+	field := m.GetRawField("082")
+	for i := 0; i < field.ValueCount(); i++ {
+		numbers = append(numbers, field.subfieldValues("a", i)...)
+	}
+	return numbers
+}
+
+// SortTitle returns a sort key for the title: the 245 $a without the number
+// of nonfiling characters given by the second indicator (such as 4 for
+// "The "), lowercased and with surrounding whitespace and trailing ISBD
+// punctuation removed.
+func (m *MarcRecord) SortTitle() string {
+	field := m.GetRawField("245")
+	if field.ValueCount() == 0 {
+		return ""
+	}
+	title := []rune(field.GetNthSubfield("a", 0))
+	if raw := field.GetRawValue(0); len(raw) > 1 && raw[1] >= '0' && raw[1] <= '9' {
+		title = title[min(int(raw[1]-'0'), len(title)):]
+	}
+	return strings.ToLower(TrimISBD(string(title)))
+}
+
+// An ISBN is an International Standard Book Number from an 020 field.
+// Number is the bare ISBN, without hyphens; Qualifier is any qualifying
+// information, such as "pbk.", without its parentheses. Canceled marks a
+// canceled or invalid ISBN ($z).
+type ISBN struct {
+	Number    string
+	Qualifier string
+	Canceled  bool
+}
+
+// ISBNs returns the valid ($a) and canceled ($z) ISBNs in each 020, in
+// order. The qualifier is taken from the parenthesized text following the
+// number or, failing that, from $q.
+func (m *MarcRecord) ISBNs() []ISBN {
+	isbns := make([]ISBN, 0)
+	field := m.GetRawField("020")
+	for i := 0; i < field.ValueCount(); i++ {
+		qualifier := ""
+		if q := field.subfieldValues("q", i); len(q) > 0 {
+			qualifier = strings.Trim(q[0], " ()")
+		}
+		for _, code := range []string{"a", "z"} {
+			for _, v := range field.subfieldValues(code, i) {
+				isbn := parseISBN(v)
+				if isbn.Qualifier == "" {
+					isbn.Qualifier = qualifier
+				}
+				isbn.Canceled = code == "z"
+				isbns = append(isbns, isbn)
+			}
+		}
+	}
+	return isbns
+}
+
+// parseISBN separates the number in an 020 value such as
+// "978-0-12-345678-9 (pbk.)" from its qualifier.
+func parseISBN(v string) ISBN {
+	v = strings.TrimSpace(v)
+	end := 0
+	for end < len(v) && strings.IndexByte("0123456789Xx-", v[end]) != -1 {
+		end++
+	}
+	number := strings.ToUpper(strings.Replace(v[:end], "-", "", -1))
+	return ISBN{Number: number, Qualifier: strings.Trim(v[end:], " :;()")}
+}
+
+// An Extent is the physical description from a 300 field: its extent ($a),
+// other physical details ($b), and dimensions ($c), with trailing ISBD
+// punctuation removed.
+type Extent struct {
+	Extent     string
+	Details    string
+	Dimensions string
+}
+
+// PhysicalDescription returns the physical description from each 300.
+func (m *MarcRecord) PhysicalDescription() []Extent {
+	extents := make([]Extent, 0)
+	field := m.GetRawField("300")
+	for i := 0; i < field.ValueCount(); i++ {
+		extents = append(extents, Extent{
+			field.GetNthSubfieldTrimmed("a", i),
+			field.GetNthSubfieldTrimmed("b", i),
+			field.GetNthSubfieldTrimmed("c", i),
+		})
+	}
+	return extents
+}
+
+// A SystemNumber is a control number and the organization or system that
+// assigned it, such as "OCoLC" for OCLC numbers. Source is empty when the
+// record does not say.
+type SystemNumber struct {
+	Source string
+	Value  string
+}
+
+// SystemControlNumbers returns the record's control number (001), with its
+// source taken from the 003, followed by each system control number in 035
+// $a, whose source is the parenthesized prefix, e.g. "(OCoLC)83544809".
+func (m *MarcRecord) SystemControlNumbers() []SystemNumber {
+	numbers := make([]SystemNumber, 0)
+	if cn := m.ControlNumber(); cn != "" {
+		numbers = append(numbers, SystemNumber{m.FirstControlField("003"), cn})
+	}
+
+	field := m.GetRawField("035")
+	for i := 0; i < field.ValueCount(); i++ {
+		for _, v := range field.subfieldValues("a", i) {
+			v = strings.TrimSpace(v)
+			source := ""
+			if strings.HasPrefix(v, "(") {
+				if end := strings.IndexByte(v, ')'); end != -1 {
+					source, v = v[1:end], strings.TrimSpace(v[end+1:])
+				}
+			}
+			if v != "" {
+				numbers = append(numbers, SystemNumber{source, v})
+			}
+		}
+	}
+	return numbers
+}
+
+// Fixed008 holds the 008 positions shared by every material type: 00-17 and
+// 35-39. The values are as recorded, including any blanks or fill
+// characters ('|').
+type Fixed008 struct {
+	DateEntered      string // 00-05, yymmdd
+	DateType         byte   // 06, type of date/publication status
+	Date1            string // 07-10
+	Date2            string // 11-14
+	Place            string // 15-17, place of publication, production, or execution
+	Language         string // 35-37
+	ModifiedRecord   byte   // 38
+	CatalogingSource byte   // 39
+}
+
+// Fixed008 parses the shared positions of the record's 008. It returns an
+// error if the record has no 008 or it is shorter than 40 characters.
+func (m *MarcRecord) Fixed008() (*Fixed008, error) {
+	data := m.GetRawFieldData("008")
+	if len(data) == 0 {
+		return nil, fmt.Errorf("marc21: record has no 008 field")
+	}
+	f := data[0]
+	if len(f) < 40 {
+		return nil, fmt.Errorf("marc21: 008 field is %d characters, expected 40", len(f))
+	}
+	return &Fixed008{
+		DateEntered:      string(f[0:6]),
+		DateType:         f[6],
+		Date1:            string(f[7:11]),
+		Date2:            string(f[11:15]),
+		Place:            string(f[15:18]),
+		Language:         string(f[35:38]),
+		ModifiedRecord:   f[38],
+		CatalogingSource: f[39],
+	}, nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"testing"
+)
+
+func TestURLs(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	if urls := m.URLs(); len(urls) != 0 {
+		t.Errorf("Record without 856 should have no URLs: %v", urls)
+	}
+
+	m.AddDataField("856", '4', '0', Subfield{"u", "http://example.org/a"}, Subfield{"z", "Full text"})
+	m.AddDataField("856", '4', '1', Subfield{"3", "Finding aid"}, Subfield{"u", "http://example.org/b"})
+
+	urls := m.URLs()
+	if len(urls) != 2 || urls[0] != "http://example.org/a" || urls[1] != "http://example.org/b" {
+		t.Errorf("URLs are wrong: %v", urls)
+	}
+}
+
+func TestClassification(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	if len(m.LCClassification()) != 0 || len(m.DeweyClassification()) != 0 {
+		t.Errorf("Record without 050 or 082 should have no classification")
+	}
+
+	m.AddDataField("050", '0', '0', Subfield{"a", "N5020.S3"}, Subfield{"b", "A5 1937"})
+	m.AddDataField("082", '0', '4', Subfield{"a", "708.9794"}, Subfield{"2", "23"})
+
+	if lc := m.LCClassification(); len(lc) != 1 || lc[0] != "N5020.S3 A5 1937" {
+		t.Errorf("LC classification is wrong: %v", lc)
+	}
+	if ddc := m.DeweyClassification(); len(ddc) != 1 || ddc[0] != "708.9794" {
+		t.Errorf("Dewey classification is wrong: %v", ddc)
+	}
+}
+
+func TestSortTitle(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	if title := m.SortTitle(); title != "garden exhibition" {
+		t.Errorf("Sort title is wrong: %q", title)
+	}
+
+	m, _ = NewRecordBuilder().
+		AddControlField("001", "000000002-7").
+		AddDataField("245", '1', '4', Subfield{"a", "The Garden exhibition /"}).
+		Build()
+	if title := m.SortTitle(); title != "garden exhibition" {
+		t.Errorf("Sort title should omit the nonfiling article: %q", title)
+	}
+}
+
+func TestISBNs(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	if isbns := m.ISBNs(); len(isbns) != 0 {
+		t.Errorf("Record without 020 should have no ISBNs: %v", isbns)
+	}
+
+	m.AddDataField("020", ' ', ' ', Subfield{"a", "9780123456789 (pbk.)"}, Subfield{"z", "0-12-345678-X"})
+	m.AddDataField("020", ' ', ' ', Subfield{"a", "9780123456796"}, Subfield{"q", "hardcover"})
+
+	expected := []ISBN{
+		{"9780123456789", "pbk.", false},
+		{"012345678X", "", true},
+		{"9780123456796", "hardcover", false},
+	}
+	isbns := m.ISBNs()
+	if len(isbns) != len(expected) {
+		t.Fatalf("Expected %d ISBNs, got %v", len(expected), isbns)
+	}
+	for i := range expected {
+		if isbns[i] != expected[i] {
+			t.Errorf("ISBN %d is wrong: %+v", i, isbns[i])
+		}
+	}
+}
+
+func TestPhysicalDescription(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	extents := m.PhysicalDescription()
+	if len(extents) != 1 {
+		t.Fatalf("Expected one extent, got %v", extents)
+	}
+	if extents[0] != (Extent{"1 folded sheet (4p.)", "", "14 cm."}) {
+		t.Errorf("Extent is wrong: %+v", extents[0])
+	}
+}
+
+func TestSystemControlNumbers(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	numbers := m.SystemControlNumbers()
+	if len(numbers) != 2 || numbers[0] != (SystemNumber{"", "000000002-7"}) || numbers[1] != (SystemNumber{"", "ocm83544809"}) {
+		t.Errorf("System control numbers are wrong: %v", numbers)
+	}
+
+	m.AddControlField("003", "CStRLIN")
+	m.AddDataField("035", ' ', ' ', Subfield{"a", "(OCoLC)83544809"})
+	numbers = m.SystemControlNumbers()
+	if len(numbers) != 3 || numbers[0].Source != "CStRLIN" || numbers[2] != (SystemNumber{"OCoLC", "83544809"}) {
+		t.Errorf("System control numbers with sources are wrong: %v", numbers)
+	}
+}
+
+func TestFixed008(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	f, err := m.Fixed008()
+	if err != nil {
+		t.Fatalf("Unable to parse 008: %v", err)
+	}
+	expected := Fixed008{"821202", '|', "1937", "    ", "|||", "eng", '|', 'd'}
+	if *f != expected {
+		t.Errorf("008 parsed wrongly: %+v", *f)
+	}
+
+	m, _ = NewRecordBuilder().AddControlField("008", "821202s1937").Build()
+	if _, err := m.Fixed008(); err == nil {
+		t.Errorf("Short 008 should be an error")
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"fmt"
+)
+
+// defaultLeader is used by a RecordBuilder whose leader is never set: a new
+// UTF-8 encoded language material monograph.
+const defaultLeader = "00000nam a2200000   4500"
+
+// A RecordBuilder constructs a record field by field. Errors are deferred
+// until Build so that calls can be chained.
+type RecordBuilder struct {
+	leader []byte
+	fields []rawField
+	err    error
+}
+
+func NewRecordBuilder() *RecordBuilder {
+	b := new(RecordBuilder)
+	b.leader = []byte(defaultLeader)
+	return b
+}
+
+// SetLeader sets the leader. The record length and base address positions
+// are ignored; Build computes them.
+func (b *RecordBuilder) SetLeader(leader string) *RecordBuilder {
+	if len(leader) != leaderSize {
+		b.setErr(fmt.Errorf("marc21: leader must be %d bytes, got %d", leaderSize, len(leader)))
+		return b
+	}
+	b.leader = []byte(leader)
+	return b
+}
+
+// AddControlField appends a control field.
+func (b *RecordBuilder) AddControlField(tag, value string) *RecordBuilder {
+	tag = NormalizeTag(tag)
+	if len(tag) != 3 || !IsControlFieldTag(tag) {
+		b.setErr(fmt.Errorf("marc21: \"%s\" is not a valid control field", tag))
+		return b
+	}
+	b.fields = append(b.fields, rawField{tag: tag, data: append([]byte(value), fieldTerminator)})
+	return b
+}
+
+// AddDataField appends a data field.
+func (b *RecordBuilder) AddDataField(tag string, ind1, ind2 byte, subfields ...Subfield) *RecordBuilder {
+	tag = NormalizeTag(tag)
+	if len(tag) != 3 || IsControlFieldTag(tag) {
+		b.setErr(fmt.Errorf("marc21: \"%s\" is not a data field", tag))
+		return b
+	}
+	b.fields = append(b.fields, rawField{tag: tag, data: encodeDataField(ind1, ind2, subfields)})
+	return b
+}
+
+// Build serializes the fields, in the order they were added, into a new
+// record. It returns the first error from any earlier call.
+func (b *RecordBuilder) Build() (*MarcRecord, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	raw, err := encodeRecord(b.leader, b.fields)
+	if err != nil {
+		return nil, err
+	}
+	return NewMarcRecord(raw, false, 0)
+}
+
+// Split builds the record like Build, but if it would exceed the maximum
+// MARC record length it is partitioned into several records, each within the
+// limit. Every part carries the control fields and leader of the whole, and
+// the data fields are distributed in order. The first part keeps the control
+// number (001); each later part is given its own by appending its part
+// number, e.g. "cn-2" and "cn-3". The first part's leader position 19 is set
+// to 'a' (set) and the others to 'c' (part with dependent title); every part
+// after the first has a 773 host item entry linking to the first by its
+// control number ($w) and numbering the part ($g).
+func (b *RecordBuilder) Split() ([]*MarcRecord, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if m, err := b.Build(); err != errRecordTooLarge {
+		if err != nil {
+			return nil, err
+		}
+		return []*MarcRecord{m}, nil
+	}
+
+	control := make([]rawField, 0)
+	data := make([]rawField, 0)
+	cn := ""
+	for _, f := range b.fields {
+		if IsControlFieldTag(f.tag) {
+			control = append(control, f)
+			if f.tag == "001" && cn == "" {
+				cn = string(f.data[:len(f.data)-1])
+			}
+		} else {
+			data = append(data, f)
+		}
+	}
+
+	// the size of a part's leader, control fields, directory terminator,
+	// and record terminator, plus room for the 773 link
+	overhead := leaderSize + 2 + len(splitLink(cn, 9999, 9999).data) + entrySize
+	for _, f := range control {
+		overhead += entrySize + len(f.data)
+	}
+	if cn != "" {
+		overhead += len(partNumber(cn, 9999))
+	}
+
+	groups := make([][]rawField, 0)
+	size := overhead
+	group := make([]rawField, 0)
+	for _, f := range data {
+		if overhead+entrySize+len(f.data) > maxRecordSize {
+			return nil, errFieldTooLarge
+		}
+		if size+entrySize+len(f.data) > maxRecordSize {
+			groups = append(groups, group)
+			group = make([]rawField, 0)
+			size = overhead
+		}
+		group = append(group, f)
+		size += entrySize + len(f.data)
+	}
+	groups = append(groups, group)
+
+	parts := make([]*MarcRecord, len(groups))
+	for i, group := range groups {
+		leader := append([]byte(nil), b.leader...)
+		fields := append([]rawField(nil), control...)
+		if i == 0 {
+			leader[19] = 'a'
+		} else {
+			leader[19] = 'c'
+			for j := range fields {
+				if fields[j].tag == "001" {
+					fields[j] = rawField{tag: "001", data: append([]byte(partNumber(cn, i+1)), fieldTerminator)}
+					break
+				}
+			}
+			fields = insertOrdered(fields, splitLink(cn, i+1, len(groups)))
+		}
+		fields = append(fields, group...)
+		raw, err := encodeRecord(leader, fields)
+		if err != nil {
+			return nil, err
+		}
+		if parts[i], err = NewMarcRecord(raw, false, 0); err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+// partNumber returns the control number of part n of a split record whose
+// first part has control number cn.
+func partNumber(cn string, n int) string {
+	return fmt.Sprintf("%s-%d", cn, n)
+}
+
+// splitLink returns the 773 linking part n of a split record to its first
+// part.
+func splitLink(cn string, n, count int) rawField {
+	subfields := make([]Subfield, 0, 2)
+	if cn != "" {
+		subfields = append(subfields, Subfield{"w", cn})
+	}
+	subfields = append(subfields, Subfield{"g", fmt.Sprintf("part %d of %d", n, count)})
+	return rawField{tag: "773", data: encodeDataField('0', '8', subfields)}
+}
+
+func (b *RecordBuilder) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRecordBuilder(t *testing.T) {
+	m, err := NewRecordBuilder().
+		AddControlField("001", "rec-1").
+		AddControlField("008", "821202s1937    cau           000 0 eng d").
+		AddDataField("245", '0', '0', Subfield{"a", "Garden exhibition /"}, Subfield{"c", "SFMA."}).
+		Build()
+	if err != nil {
+		t.Fatalf("Unable to build record: %v", err)
+	}
+
+	r := NewReader(bytes.NewReader(m.RawRecord), true)
+	rec, err := r.Next()
+	if err != nil || rec == nil {
+		t.Fatalf("Unable to read built record: %v", err)
+	}
+	if cn := rec.ControlNumber(); cn != "rec-1" {
+		t.Errorf("001 is wrong: %v", cn)
+	}
+	if f, _ := rec.GetControlField("008"); len(f) != 40 {
+		t.Errorf("008 should be 40 characters, got %d", len(f))
+	}
+	field := rec.GetRawField("245")
+	if v := field.GetNthSubfield("c", 0); v != "SFMA." {
+		t.Errorf("245$c is wrong: %v", v)
+	}
+	if l := rec.GetLeader(); l[5:12] != "nam a22" || l[17:] != "   4500" {
+		t.Errorf("Leader is wrong: %v", l)
+	}
+}
+
+func TestRecordBuilderErrors(t *testing.T) {
+	if _, err := NewRecordBuilder().SetLeader("short").Build(); err == nil {
+		t.Errorf("Short leader should fail")
+	}
+	if _, err := NewRecordBuilder().AddDataField("001", ' ', ' ').Build(); err == nil {
+		t.Errorf("Data field with control tag should fail")
+	}
+}
+
+func TestRecordBuilderSplit(t *testing.T) {
+	b := NewRecordBuilder().
+		AddControlField("001", "big-1").
+		AddDataField("245", '0', '0', Subfield{"a", "Oversize record"})
+	for i := 0; i < 30; i++ {
+		b.AddDataField("500", ' ', ' ', Subfield{"a", strings.Repeat("x", 9000)})
+	}
+	if _, err := b.Build(); err == nil {
+		t.Fatalf("Oversize record should not build as a single record")
+	}
+
+	parts, err := b.Split()
+	if err != nil {
+		t.Fatalf("Unable to split record: %v", err)
+	}
+	if len(parts) < 3 {
+		t.Fatalf("Expected at least 3 parts, got %d", len(parts))
+	}
+
+	notes := 0
+	for i, p := range parts {
+		if len(p.RawRecord) > maxRecordSize {
+			t.Errorf("Part %d is too large: %d bytes", i, len(p.RawRecord))
+		}
+		if _, err := NewMarcRecord(p.RawRecord, true, 0); err != nil {
+			t.Errorf("Part %d is not a valid record: %v", i, err)
+		}
+		cn := "big-1"
+		if i > 0 {
+			cn = fmt.Sprintf("big-1-%d", i+1)
+		}
+		if p.ControlNumber() != cn {
+			t.Errorf("Part %d has control number %q, expected %q", i, p.ControlNumber(), cn)
+		}
+		link := p.GetRawField("773")
+		if i == 0 && link.ValueCount() != 0 {
+			t.Errorf("First part should not link to itself")
+		}
+		if i > 0 && link.GetNthSubfield("w", 0) != "big-1" {
+			t.Errorf("Part %d does not link to the first part", i)
+		}
+		notes += len(p.GetRawFieldData("500"))
+	}
+	if notes != 30 {
+		t.Errorf("Parts should hold all 30 notes, got %d", notes)
+	}
+
+	small, err := NewRecordBuilder().AddControlField("001", "small").Split()
+	if err != nil || len(small) != 1 {
+		t.Errorf("Record that fits should not be split: %v", err)
+	}
+	if same, err := small[0].Split(); err != nil || len(same) != 1 || !same[0].Equal(small[0]) {
+		t.Errorf("MarcRecord.Split should return the record's content: %v", err)
+	}
+
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	if same, err := m.Split(); err != nil || len(same) != 1 || !bytes.Equal(same[0].RawRecord, m.RawRecord) {
+		t.Errorf("MarcRecord.Split should rebuild the record byte for byte: %v", err)
+	}
+}
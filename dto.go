@@ -0,0 +1,121 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// A RecordDTO is a plain representation of a record for marshaling with any
+// codec. Values are the untranscoded bytes of the record, so it can be
+// rebuilt exactly whatever its character encoding; a codec such as JSON
+// that has no byte string type encodes them as base64.
+type RecordDTO struct {
+	Leader string     `json:"leader" protobuf:"bytes,1,opt,name=leader"`
+	Fields []FieldDTO `json:"fields" protobuf:"bytes,2,rep,name=fields"`
+}
+
+// A FieldDTO is a single field instance. A control field has only a Value;
+// a data field has indicators and subfields. Impl holds the field's
+// implementation-defined directory bytes, if any.
+type FieldDTO struct {
+	Tag       string        `json:"tag" protobuf:"bytes,1,opt,name=tag"`
+	Value     []byte        `json:"value,omitempty" protobuf:"bytes,2,opt,name=value"`
+	Ind1      string        `json:"ind1,omitempty" protobuf:"bytes,3,opt,name=ind1"`
+	Ind2      string        `json:"ind2,omitempty" protobuf:"bytes,4,opt,name=ind2"`
+	Subfields []SubfieldDTO `json:"subfields,omitempty" protobuf:"bytes,5,rep,name=subfields"`
+	Impl      []byte        `json:"impl,omitempty" protobuf:"bytes,6,opt,name=impl"`
+}
+
+// A SubfieldDTO is a single subfield. Data following the indicators that is
+// not introduced by a delimiter, read elsewhere as an implicit $a, is a
+// first subfield with an empty Code.
+type SubfieldDTO struct {
+	Code  string `json:"code" protobuf:"bytes,1,opt,name=code"`
+	Value []byte `json:"value" protobuf:"bytes,2,opt,name=value"`
+}
+
+// ToDTO returns the record's leader and fields, in directory order.
+func (m *MarcRecord) ToDTO() RecordDTO {
+	dto := RecordDTO{m.GetLeader(), make([]FieldDTO, 0)}
+	sd, ft := m.delims.get()
+	for _, f := range m.rawFields() {
+		data := f.data
+		if n := len(data); n > 0 && data[n-1] == ft {
+			data = data[:n-1]
+		}
+		impl := append([]byte(nil), f.impl...)
+		if IsControlFieldTag(f.tag) {
+			dto.Fields = append(dto.Fields, FieldDTO{Tag: f.tag, Value: append([]byte(nil), data...), Impl: impl})
+			continue
+		}
+
+		fd := FieldDTO{Tag: f.tag, Subfields: make([]SubfieldDTO, 0), Impl: impl}
+		if len(data) >= 2 {
+			fd.Ind1, fd.Ind2 = string(data[0]), string(data[1])
+			for i, chunk := range bytes.Split(data[2:], []byte{sd}) {
+				switch {
+				case i == 0 && len(chunk) > 0:
+					fd.Subfields = append(fd.Subfields, SubfieldDTO{"", append([]byte(nil), chunk...)})
+				case i > 0 && len(chunk) > 0:
+					fd.Subfields = append(fd.Subfields, SubfieldDTO{string(chunk[0]), append([]byte(nil), chunk[1:]...)})
+				}
+			}
+		}
+		dto.Fields = append(dto.Fields, fd)
+	}
+	return dto
+}
+
+// FromDTO builds a record from a RecordDTO. The record length and base
+// address in the leader are recomputed. Subfields are delimited as in MARC 21.
+func FromDTO(dto RecordDTO) (*MarcRecord, error) {
+	if len(dto.Leader) != leaderSize {
+		return nil, fmt.Errorf("marc21: leader must be %d bytes, got %d", leaderSize, len(dto.Leader))
+	}
+	fields := make([]rawField, 0, len(dto.Fields))
+	for _, f := range dto.Fields {
+		tag := NormalizeTag(f.Tag)
+		if len(tag) != 3 {
+			return nil, fmt.Errorf("marc21: \"%s\" is not a valid tag", f.Tag)
+		}
+		if IsControlFieldTag(tag) {
+			data := append(append([]byte(nil), f.Value...), fieldTerminator)
+			fields = append(fields, rawField{tag: tag, data: data, impl: f.Impl})
+			continue
+		}
+		if len(f.Ind1) != 1 || len(f.Ind2) != 1 {
+			return nil, fmt.Errorf("marc21: %s field has malformed indicators", tag)
+		}
+		data := []byte{f.Ind1[0], f.Ind2[0]}
+		for i, sf := range f.Subfields {
+			switch {
+			case len(sf.Code) == 1:
+				data = append(data, delimiter, sf.Code[0])
+			case sf.Code != "" || i > 0:
+				return nil, fmt.Errorf("marc21: %s field has malformed subfield code %q", tag, sf.Code)
+			}
+			data = append(data, sf.Value...)
+		}
+		fields = append(fields, rawField{tag: tag, data: append(data, fieldTerminator), impl: f.Impl})
+	}
+
+	raw, err := encodeRecord([]byte(dto.Leader), fields)
+	if err != nil {
+		return nil, err
+	}
+	return NewMarcRecord(raw, false, 0)
+}
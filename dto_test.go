@@ -0,0 +1,79 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDTORoundTrip(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+
+	dto := m.ToDTO()
+	if len(dto.Fields) != 11 || dto.Fields[4].Tag != "245" || string(dto.Fields[4].Subfields[1].Value) != "San Francisco Museum of Art." {
+		t.Errorf("DTO is wrong: %+v", dto.Fields)
+	}
+
+	encoded, err := json.Marshal(dto)
+	if err != nil {
+		t.Fatalf("Unable to marshal DTO: %v", err)
+	}
+	var decoded RecordDTO
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("Unable to unmarshal DTO: %v", err)
+	}
+
+	rebuilt, err := FromDTO(decoded)
+	if err != nil {
+		t.Fatalf("Unable to rebuild record: %v", err)
+	}
+	if string(rebuilt.RawRecord) != fullRecord {
+		t.Errorf("Record did not round trip:\n%q", rebuilt.RawRecord)
+	}
+}
+
+func TestDTORoundTripMARC8(t *testing.T) {
+	// a MARC-8 record whose 245 has an acute (0xE2), data before its first
+	// delimiter, and implementation-defined directory bytes
+	m, _ := NewRecordBuilder().
+		SetLeader("00000nam  2200000   4500").
+		AddControlField("001", "000000002-7").
+		AddDataField("245", '0', '0', Subfield{"c", "San Francisco Museum of Art."}).
+		Build()
+	fields := m.rawFields()
+	fields[1].data = []byte("00Garden exhibition \xe2e /\x1fcSan Francisco Museum of Art.\x1e")
+	fields[1].impl = []byte("7")
+	if err := m.setFields(fields); err != nil {
+		t.Fatalf("Unable to build record: %v", err)
+	}
+	original := string(m.RawRecord)
+
+	encoded, err := json.Marshal(m.ToDTO())
+	if err != nil {
+		t.Fatalf("Unable to marshal DTO: %v", err)
+	}
+	var decoded RecordDTO
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("Unable to unmarshal DTO: %v", err)
+	}
+	rebuilt, err := FromDTO(decoded)
+	if err != nil {
+		t.Fatalf("Unable to rebuild record: %v", err)
+	}
+	if string(rebuilt.RawRecord) != original {
+		t.Errorf("MARC-8 record did not round trip:\n%q\n%q", rebuilt.RawRecord, original)
+	}
+}
@@ -0,0 +1,450 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+var (
+	errRecordTooLarge = errors.New("marc21: record is too large to encode")
+	errFieldTooLarge  = errors.New("marc21: field is too large to encode")
+)
+
+const (
+	entrySize      = 12
+	maxFieldLength = 9999
+)
+
+// A Subfield is a subfield code and its (untranscoded) value.
+type Subfield struct {
+	Code  string
+	Value string
+}
+
+// A rawField is a single field instance: the tag, the field data, including
+// the trailing field terminator, and the implementation-defined part of its
+// directory entry, if the record has one.
+type rawField struct {
+	tag  string
+	data []byte
+	impl []byte
+}
+
+// rawFields returns every field instance in directory order.
+func (m *MarcRecord) rawFields() []rawField {
+	// RawRecord has already been parsed successfully
+	entries, _ := decodeEntries(m.RawRecord)
+	fields := make([]rawField, len(entries))
+	for i, e := range entries {
+		fields[i] = rawField{e.tag, m.RawRecord[e.offset : e.offset+e.length], e.impl}
+	}
+	return fields
+}
+
+// Canonicalize sorts the record's fields by tag, keeping repeated fields in
+// their existing order. Nothing else reorders fields: a record that is read
+// and written without calling Canonicalize keeps its original field order.
+func (m *MarcRecord) Canonicalize() error {
+	fields := m.rawFields()
+	sort.SliceStable(fields, func(i, j int) bool {
+		return fields[i].tag < fields[j].tag
+	})
+	return m.setFields(fields)
+}
+
+// Split partitions the record as RecordBuilder.Split would, building from
+// the record's leader and fields. Since a MarcRecord is always encoded, and
+// an edit that would make it too large fails instead, this normally returns
+// a single part with the record's content. The parts keep the transcoder and
+// delimiters the record was read with.
+func (m *MarcRecord) Split() ([]*MarcRecord, error) {
+	b := NewRecordBuilder()
+	b.leader = append([]byte(nil), m.RawRecord[:leaderSize]...)
+	b.fields = m.rawFields()
+	parts, err := b.Split()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range parts {
+		p.transcoder, p.decoder, p.delims = m.transcoder, m.decoder, m.delims
+	}
+	return parts, nil
+}
+
+// Equal reports whether two records have the same content: the same leader,
+// apart from the computed record length and base address, and the same
+// fields with the same indicators and subfields, in any order.
+func (m *MarcRecord) Equal(other *MarcRecord) bool {
+	l1, l2 := m.RawRecord[:leaderSize], other.RawRecord[:leaderSize]
+	if !bytes.Equal(l1[5:12], l2[5:12]) || !bytes.Equal(l1[17:], l2[17:]) {
+		return false
+	}
+
+	f1, f2 := m.fieldKeys(), other.fieldKeys()
+	if len(f1) != len(f2) {
+		return false
+	}
+	for i := range f1 {
+		if f1[i] != f2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ContentHash returns a SHA-256 hash of the record's content, for detecting
+// whether a record has changed in substance. Like Equal it ignores the
+// computed record length and base address and the order of the fields; it
+// also ignores the 005 transaction timestamp.
+func (m *MarcRecord) ContentHash() [32]byte {
+	h := sha256.New()
+	h.Write(m.RawRecord[5:12])
+	h.Write(m.RawRecord[17:leaderSize])
+	for _, key := range m.fieldKeys() {
+		// every key ends in a field terminator, so they cannot run together
+		if key[:3] != "005" {
+			io.WriteString(h, key)
+		}
+	}
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// fieldKeys returns the tag and data of each field as a sorted list.
+func (m *MarcRecord) fieldKeys() []string {
+	fields := m.rawFields()
+	keys := make([]string, len(fields))
+	for i, f := range fields {
+		keys[i] = f.tag + string(f.data)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// setFields replaces the record's fields, reserializing RawRecord with a
+// freshly computed length, base address, and directory.
+func (m *MarcRecord) setFields(fields []rawField) error {
+	raw, err := encodeRecord(m.RawRecord[:leaderSize], fields)
+	if err != nil {
+		return err
+	}
+	dir, err := decodeDirectory(raw)
+	if err != nil {
+		return err
+	}
+	m.RawRecord = raw
+	m.Directory = dir
+	m.dirty, m.modified = true, true
+	return nil
+}
+
+// Bytes serializes the record, recomputing its leader and directory, as a
+// Writer does for a modified record. The result is a new slice.
+func (m *MarcRecord) Bytes() ([]byte, error) {
+	return encodeRecord(m.RawRecord[:leaderSize], m.rawFields())
+}
+
+// MisterminatedFields returns the directory entries of the fields that do
+// not end in a field terminator, as written by some faulty exporters.
+func (m *MarcRecord) MisterminatedFields() []DirectoryEntry {
+	bad := make([]DirectoryEntry, 0)
+	for _, e := range m.DirectoryEntries() {
+		if e.Length == 0 || m.RawRecord[e.Offset+e.Length-1] != fieldTerminator {
+			bad = append(bad, e)
+		}
+	}
+	return bad
+}
+
+// RepairFieldTerminators replaces the last byte of each field returned by
+// MisterminatedFields with a field terminator. The field lengths, and so the
+// directory, are unchanged.
+func (m *MarcRecord) RepairFieldTerminators() {
+	if len(m.MisterminatedFields()) == 0 {
+		return
+	}
+	m.RawRecord = repairTerminators(m.RawRecord)
+	m.modified = true
+}
+
+// Modified reports whether the record has been changed since it was parsed
+// or built.
+func (m *MarcRecord) Modified() bool {
+	return m.modified
+}
+
+// insertField adds f after the last field whose tag sorts at or before its
+// own, so that a record with ordered fields remains ordered.
+func (m *MarcRecord) insertField(f rawField) error {
+	return m.setFields(insertOrdered(m.rawFields(), f))
+}
+
+func insertOrdered(fields []rawField, f rawField) []rawField {
+	i := len(fields)
+	for i > 0 && fields[i-1].tag > f.tag {
+		i--
+	}
+	fields = append(fields, rawField{})
+	copy(fields[i+1:], fields[i:])
+	fields[i] = f
+	return fields
+}
+
+// AddControlField adds a control field with the given value.
+func (m *MarcRecord) AddControlField(tag, value string) error {
+	tag = NormalizeTag(tag)
+	if len(tag) != 3 || !IsControlFieldTag(tag) {
+		return fmt.Errorf("marc21: \"%s\" is not a valid control field", tag)
+	}
+	data := append([]byte(value), fieldTerminator)
+	return m.insertField(rawField{tag: tag, data: data})
+}
+
+// AddDataField adds a data field with the given indicators and subfields.
+func (m *MarcRecord) AddDataField(tag string, ind1, ind2 byte, subfields ...Subfield) error {
+	tag = NormalizeTag(tag)
+	if len(tag) != 3 || IsControlFieldTag(tag) {
+		return fmt.Errorf("marc21: \"%s\" is not a data field", tag)
+	}
+	return m.insertField(rawField{tag: tag, data: encodeDataField(ind1, ind2, subfields)})
+}
+
+// RetagField changes the tag of every instance of oldTag to newTag. Both tags
+// must be control fields or both data fields. The retagged fields are moved
+// to their position in tag order; the other fields keep their order.
+func (m *MarcRecord) RetagField(oldTag, newTag string) error {
+	oldTag, newTag = NormalizeTag(oldTag), NormalizeTag(newTag)
+	if len(oldTag) != 3 || len(newTag) != 3 || IsControlFieldTag(oldTag) != IsControlFieldTag(newTag) {
+		return fmt.Errorf("marc21: cannot retag \"%s\" as \"%s\"", oldTag, newTag)
+	}
+	if m.Directory[oldTag] == nil {
+		return fmt.Errorf("marc21: no \"%s\" field to retag", oldTag)
+	}
+
+	retagged := make([]rawField, 0)
+	fields := make([]rawField, 0)
+	for _, f := range m.rawFields() {
+		if f.tag == oldTag {
+			retagged = append(retagged, rawField{newTag, f.data, f.impl})
+		} else {
+			fields = append(fields, f)
+		}
+	}
+	for _, f := range retagged {
+		fields = insertOrdered(fields, f)
+	}
+	return m.setFields(fields)
+}
+
+// DeleteSubfields removes every code subfield from every instance of the tag
+// data field. The emptied fields themselves remain in the record.
+func (m *MarcRecord) DeleteSubfields(tag, code string) error {
+	tag = NormalizeTag(tag)
+	if len(tag) != 3 || IsControlFieldTag(tag) {
+		return fmt.Errorf("marc21: \"%s\" is not a data field", tag)
+	}
+
+	sd, ft := m.delims.get()
+	fields := m.rawFields()
+	for i, f := range fields {
+		if f.tag != tag || len(f.data) < 2 {
+			continue
+		}
+		data := []byte{f.data[0], f.data[1]}
+		for _, sf := range subfieldChunks(f.data[2:], m.delims) {
+			if string(sf[:1]) != code {
+				data = append(data, sd)
+				data = append(data, sf...)
+			}
+		}
+		fields[i].data = append(data, ft)
+	}
+	return m.setFields(fields)
+}
+
+// StripVernacular removes every 880 alternate graphic representation and the
+// $6 subfields linking other fields to them, leaving only the romanized
+// fields.
+func (m *MarcRecord) StripVernacular() error {
+	sd, ft := m.delims.get()
+	fields := make([]rawField, 0)
+	for _, f := range m.rawFields() {
+		if f.tag == "880" {
+			continue
+		}
+		if !IsControlFieldTag(f.tag) && len(f.data) >= 2 {
+			data := []byte{f.data[0], f.data[1]}
+			for _, sf := range subfieldChunks(f.data[2:], m.delims) {
+				if sf[0] == '6' && bytes.HasPrefix(sf[1:], []byte("880")) {
+					continue
+				}
+				data = append(data, sd)
+				data = append(data, sf...)
+			}
+			f.data = append(data, ft)
+		}
+		fields = append(fields, f)
+	}
+	return m.setFields(fields)
+}
+
+// RenumberLinks reassigns the occurrence numbers in the $6 linkage subfields
+// pairing fields with their 880 alternate graphic representations, so the
+// pairs are numbered 01, 02, ... in record order. A $6 linking to an 880
+// that is missing is removed, and an 880 whose field is missing is given
+// occurrence number 00, marking it as unlinked.
+func (m *MarcRecord) RenumberLinks() error {
+	fields := m.rawFields()
+	linked := func(f rawField) (string, int) {
+		vf := VariableField{f.tag, [][]byte{f.data}, m.transcoder, m.delims}
+		return vf.LinkTag(0)
+	}
+
+	// the 880s by the tag and occurrence number they link to
+	vernacular := make(map[string]int)
+	for i, f := range fields {
+		if f.tag != "880" {
+			continue
+		}
+		if tag, occ := linked(f); tag != "" && occ != 0 {
+			vernacular[fmt.Sprintf("%s-%02d", tag, occ)] = i
+		}
+	}
+
+	next := 1
+	paired := make(map[int]bool)
+	for i, f := range fields {
+		if f.tag == "880" || IsControlFieldTag(f.tag) {
+			continue
+		}
+		tag, occ := linked(f)
+		if tag != "880" {
+			continue
+		}
+		j, ok := vernacular[fmt.Sprintf("%s-%02d", f.tag, occ)]
+		if !ok || paired[j] {
+			fields[i].data = relink(f.data, -1, m.delims)
+			continue
+		}
+		fields[i].data = relink(f.data, next, m.delims)
+		fields[j].data = relink(fields[j].data, next, m.delims)
+		paired[j] = true
+		next++
+	}
+	for i, f := range fields {
+		if f.tag == "880" && !paired[i] {
+			if tag, _ := linked(f); tag != "" {
+				fields[i].data = relink(f.data, 0, m.delims)
+			}
+		}
+	}
+	return m.setFields(fields)
+}
+
+// relink returns data with the occurrence number in its first $6 set to occ,
+// or with the $6 removed if occ is negative. data is delimited by d.
+func relink(data []byte, occ int, d delimiters) []byte {
+	sd, ft := d.get()
+	out := []byte{data[0], data[1]}
+	done := false
+	for _, sf := range subfieldChunks(data[2:], d) {
+		if sf[0] == '6' && !done && len(sf) >= 7 {
+			done = true
+			if occ < 0 {
+				continue
+			}
+			sf = append(append(append([]byte(nil), sf[:5]...), encodeDecimal(occ, 2)...), sf[7:]...)
+		}
+		out = append(out, sd)
+		out = append(out, sf...)
+	}
+	return append(out, ft)
+}
+
+func encodeDataField(ind1, ind2 byte, subfields []Subfield) []byte {
+	data := []byte{ind1, ind2}
+	for _, sf := range subfields {
+		data = append(data, delimiter)
+		data = append(data, sf.Code...)
+		data = append(data, sf.Value...)
+	}
+	return append(data, fieldTerminator)
+}
+
+// encodeRecord serializes a record from its leader and fields. The record
+// length, base address, and entry map in the leader are recomputed; the rest
+// of the leader is copied as is.
+func encodeRecord(leader []byte, fields []rawField) ([]byte, error) {
+	// implementation-defined directory bytes are kept, with those of any
+	// field lacking them, such as one just added, padded with spaces
+	implSize := 0
+	for _, f := range fields {
+		implSize = max(implSize, len(f.impl))
+	}
+	if implSize > 9 {
+		return nil, errInvalidDirectory
+	}
+
+	baseAddress := leaderSize + (entrySize+implSize)*len(fields) + 1
+	rlen := baseAddress + 1
+	for _, f := range fields {
+		if len(f.data) > maxFieldLength {
+			return nil, errFieldTooLarge
+		}
+		rlen += len(f.data)
+	}
+	if rlen > maxRecordSize {
+		return nil, errRecordTooLarge
+	}
+
+	raw := make([]byte, 0, rlen)
+	raw = append(raw, leader[:leaderSize]...)
+	copy(raw[0:5], encodeDecimal(rlen, 5))
+	copy(raw[12:17], encodeDecimal(baseAddress, 5))
+	// the directory is always written with the MARC 21 field length and
+	// starting position sizes
+	copy(raw[20:24], "4500")
+	raw[22] = byte('0' + implSize)
+
+	start := 0
+	for _, f := range fields {
+		raw = append(raw, f.tag...)
+		raw = append(raw, encodeDecimal(len(f.data), 4)...)
+		raw = append(raw, encodeDecimal(start, 5)...)
+		raw = append(raw, f.impl...)
+		for i := len(f.impl); i < implSize; i++ {
+			raw = append(raw, ' ')
+		}
+		start += len(f.data)
+	}
+	raw = append(raw, fieldTerminator)
+	for _, f := range fields {
+		raw = append(raw, f.data...)
+	}
+	raw = append(raw, recordTerminator)
+
+	return raw, nil
+}
+
+func encodeDecimal(n int, width int) []byte {
+	return []byte(fmt.Sprintf("%0*d", width, n))
+}
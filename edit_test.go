@@ -0,0 +1,288 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEncodeRecord(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+
+	raw, err := encodeRecord(m.RawRecord, m.rawFields())
+	if err != nil {
+		t.Fatalf("Unable to encode record: %v", err)
+	}
+	if !bytes.Equal(raw, []byte(fullRecord)) {
+		t.Errorf("Reencoded record does not match source data: %q", raw)
+	}
+}
+
+func TestAddDataField(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+
+	err := m.AddDataField("500", ' ', ' ', Subfield{"a", "Exhibition catalog."})
+	if err != nil {
+		t.Fatalf("Unable to add field: %v", err)
+	}
+	if err = m.AddDataField("001", ' ', ' '); err == nil {
+		t.Errorf("Adding a control field as a data field should fail")
+	}
+
+	m, err = NewMarcRecord(m.RawRecord, true, 0)
+	if err != nil {
+		t.Fatalf("Modified record does not parse: %v", err)
+	}
+	field := m.GetRawField("500")
+	if v := field.GetNthSubfield("a", 0); v != "Exhibition catalog." {
+		t.Errorf("Added 500$a is wrong: %v", v)
+	}
+	field = m.GetRawField("245")
+	if v := field.GetNthSubfield("a", 0); v != "Garden exhibition /" {
+		t.Errorf("Existing 245$a damaged by insertion: %v", v)
+	}
+
+	fields := m.rawFields()
+	if fields[7].tag != "500" {
+		t.Errorf("500 should be inserted before 650, got %v", fields[7].tag)
+	}
+}
+
+func TestRetagField(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	m.AddDataField("090", ' ', ' ', Subfield{"a", "N8215"}, Subfield{"b", ".S35 1937"})
+	m.AddDataField("090", ' ', ' ', Subfield{"a", "SB403"})
+
+	if err := m.RetagField("090", "050"); err != nil {
+		t.Fatalf("Unable to retag 090: %v", err)
+	}
+	if m.GetRawField("090").Tag != "" {
+		t.Errorf("090 still present after retag")
+	}
+	field := m.GetRawField("050")
+	if field.ValueCount() != 2 {
+		t.Fatalf("Expected 2 instances of 050, got %d", field.ValueCount())
+	}
+	if v := field.GetNthSubfield("a", 1); v != "SB403" {
+		t.Errorf("Second 050$a is wrong: %v", v)
+	}
+
+	fields := m.rawFields()
+	if fields[2].tag != "008" || fields[3].tag != "035" || fields[4].tag != "050" {
+		t.Errorf("Retagged fields are not in tag order")
+	}
+
+	if err := m.RetagField("050", "005"); err == nil {
+		t.Errorf("Retagging a data field as a control field should fail")
+	}
+	if err := m.RetagField("090", "050"); err == nil {
+		t.Errorf("Retagging a missing field should fail")
+	}
+}
+
+func TestEqual(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+
+	fields := m.rawFields()
+	reversed := make([]rawField, len(fields))
+	for i := range fields {
+		reversed[len(fields)-1-i] = fields[i]
+	}
+	raw, _ := encodeRecord(m.RawRecord, reversed)
+	other, err := NewMarcRecord(raw, false, 0)
+	if err != nil {
+		t.Fatalf("Unable to parse reordered record: %v", err)
+	}
+	if bytes.Equal(m.RawRecord, other.RawRecord) {
+		t.Fatalf("Reordered record should differ byte-wise")
+	}
+
+	if !m.Equal(other) {
+		t.Errorf("Records with reordered fields should be equal")
+	}
+
+	other.AddDataField("500", ' ', ' ', Subfield{"a", "Note."})
+	if m.Equal(other) {
+		t.Errorf("Records with different fields should not be equal")
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	other, _ := NewMarcRecord([]byte(strings.Replace(fullRecord, "20120831093346.0", "20261014120000.0", 1)), false, 0)
+
+	if m.ContentHash() != other.ContentHash() {
+		t.Errorf("Records differing only in 005 should hash the same")
+	}
+
+	other.AddDataField("500", ' ', ' ', Subfield{"a", "Note."})
+	if m.ContentHash() == other.ContentHash() {
+		t.Errorf("Records with different fields should hash differently")
+	}
+}
+
+func TestNormalizeTag(t *testing.T) {
+	tests := map[string]string{"1": "001", "45": "045", "245": "245", "": "", "a": "a", "LDR": "LDR"}
+	for tag, expected := range tests {
+		if n := NormalizeTag(tag); n != expected {
+			t.Errorf("NormalizeTag(%q) is %q, expected %q", tag, n, expected)
+		}
+	}
+
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+	if err := m.AddControlField("3", "DLC"); err != nil {
+		t.Errorf("Unable to add control field by numeric tag: %v", err)
+	}
+	if cf, _ := m.GetControlField("003"); cf != "DLC" {
+		t.Errorf("003 was not added: %q", cf)
+	}
+}
+
+func TestBytes(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+	m.AddDataField("500", ' ', ' ', Subfield{"a", "Exhibition leaflet."})
+	m.SetStatus('c')
+
+	raw, err := m.Bytes()
+	if err != nil {
+		t.Fatalf("Unable to serialize record: %v", err)
+	}
+	reparsed, err := NewMarcRecord(raw, true, 0)
+	if err != nil {
+		t.Fatalf("Serialized record does not parse: %v", err)
+	}
+	if !reparsed.Equal(m) || reparsed.Status != 'c' {
+		t.Errorf("Serialized record is not equivalent")
+	}
+	if &raw[0] == &m.RawRecord[0] {
+		t.Errorf("Bytes should not return RawRecord itself")
+	}
+}
+
+func TestStripVernacular(t *testing.T) {
+	m, _ := NewRecordBuilder().
+		AddControlField("001", "000000002-7").
+		AddDataField("245", '1', '0', Subfield{"6", "880-01"}, Subfield{"a", "Vystavka sadov /"}).
+		AddDataField("650", ' ', '0', Subfield{"a", "Horticultural exhibitions."}).
+		AddDataField("880", '1', '0', Subfield{"6", "245-01/(N"}, Subfield{"a", "Выставка садов /"}).
+		Build()
+
+	if err := m.StripVernacular(); err != nil {
+		t.Fatalf("Unable to strip vernacular fields: %v", err)
+	}
+	if _, err := NewMarcRecord(m.RawRecord, true, 0); err != nil {
+		t.Errorf("Stripped record does not parse: %v", err)
+	}
+	if m.Directory["880"] != nil {
+		t.Errorf("880 fields remain")
+	}
+	field := m.GetRawField("245")
+	if field.GetNthRawSubfield("6", 0) != nil || field.GetNthSubfield("a", 0) != "Vystavka sadov /" {
+		t.Errorf("245 is wrong after stripping: %q", field.GetRawValue(0))
+	}
+	if len(m.GetFieldList()) != 3 {
+		t.Errorf("Other fields should remain: %v", m.GetFieldList())
+	}
+}
+
+func TestMisterminatedFields(t *testing.T) {
+	// the 245 ends in a record terminator instead of a field terminator
+	bad := strings.Replace(fullRecord, "Art.\x1e", "Art.\x1d", 1)
+	m, err := NewMarcRecord([]byte(bad), true, 0)
+	if err != nil {
+		t.Fatalf("Unable to parse record: %v", err)
+	}
+
+	fields := m.MisterminatedFields()
+	if len(fields) != 1 || fields[0].Tag != "245" {
+		t.Fatalf("Expected the 245 to be misterminated, got %v", fields)
+	}
+
+	m.RepairFieldTerminators()
+	if len(m.MisterminatedFields()) != 0 || string(m.RawRecord) != fullRecord {
+		t.Errorf("Repair did not restore the terminator")
+	}
+
+	r := NewReaderWithPolicy(strings.NewReader(bad), Policy{RepairFieldTerminators: true})
+	if m, err := r.Next(); err != nil || string(m.RawRecord) != fullRecord {
+		t.Errorf("Reader did not repair the terminator: %v", err)
+	}
+}
+
+func TestRenumberLinks(t *testing.T) {
+	m, _ := NewRecordBuilder().
+		SetLeader("00000nam a2200000   4500").
+		AddControlField("001", "000000002-7").
+		AddDataField("245", '1', '0', Subfield{"6", "880-01"}, Subfield{"a", "Vystavka sadov /"}).
+		AddDataField("260", ' ', ' ', Subfield{"6", "880-02"}, Subfield{"a", "Moskva"}).
+		AddDataField("880", '1', '0', Subfield{"6", "245-01/(N"}, Subfield{"a", "Vystavka"}).
+		AddDataField("880", ' ', ' ', Subfield{"6", "260-02/(N"}, Subfield{"a", "Moskva"}).
+		Build()
+
+	// delete the 245 and its 880, leaving the 260 pair numbered 02
+	fields := make([]rawField, 0)
+	for _, f := range m.rawFields() {
+		if f.tag != "245" && !bytes.Contains(f.data, []byte("245-01")) {
+			fields = append(fields, f)
+		}
+	}
+	m.setFields(fields)
+
+	if err := m.RenumberLinks(); err != nil {
+		t.Fatalf("Unable to renumber links: %v", err)
+	}
+	original := m.GetRawField("260")
+	if link := original.GetNthSubfield("6", 0); link != "880-01" {
+		t.Errorf("260 $6 is %q, expected 880-01", link)
+	}
+	if f := m.VernacularField("260", 1); f == nil || f.GetNthSubfield("6", 0) != "260-01/(N" {
+		t.Errorf("880 was not renumbered to match the 260")
+	}
+	if _, err := NewMarcRecord(m.RawRecord, true, 0); err != nil {
+		t.Errorf("Renumbered record does not parse: %v", err)
+	}
+}
+
+func TestImplicitSubfieldRoundTrip(t *testing.T) {
+	m, _ := NewRecordBuilder().
+		AddControlField("001", "implicit-1").
+		AddDataField("245", '0', '0', Subfield{"b", "sub"}).
+		Build()
+	fields := m.rawFields()
+	fields[1].data = []byte("00Implicit title\x1fbsub\x1e")
+	m.setFields(fields)
+
+	if err := m.DeleteSubfields("245", "b"); err != nil {
+		t.Fatalf("Unable to delete subfields: %v", err)
+	}
+	if data := string(m.GetRawFieldData("245")[0]); data != "00\x1faImplicit title" {
+		t.Errorf("Implicit $a should be kept as $a, got %q", data)
+	}
+
+	rows := m.Flatten()
+	if len(rows) != 2 || rows[1].Code != "a" || rows[1].Value != "Implicit title" {
+		t.Errorf("Flatten lost the implicit $a: %v", rows)
+	}
+	var buf bytes.Buffer
+	NewMrkWriter(&buf).Write(m)
+	if !strings.Contains(buf.String(), "=245  00$aImplicit title\n") {
+		t.Errorf(".mrk lost the implicit $a:\n%s", buf.String())
+	}
+	if data, _ := m.MarshalJSON(); !strings.Contains(string(data), `{"a":"Implicit title"}`) {
+		t.Errorf("JSON lost the implicit $a: %s", data)
+	}
+}
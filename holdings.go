@@ -0,0 +1,111 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"strings"
+)
+
+// IsHoldings reports whether the record is a MARC 21 Holdings record, per
+// leader position 06.
+func (m *MarcRecord) IsHoldings() bool {
+	return strings.IndexByte("uvxy", m.Type) != -1
+}
+
+// A HoldingsLocation is the location of an item, from field 852.
+type HoldingsLocation struct {
+	Location       string // $a
+	Sublocation    string // $b
+	Classification string // $h
+}
+
+// HoldingsLocations returns the location in each 852 of a holdings record,
+// or nil if the record is not a holdings record.
+func (m *MarcRecord) HoldingsLocations() []HoldingsLocation {
+	if !m.IsHoldings() {
+		return nil
+	}
+	field := m.GetRawField("852")
+	result := make([]HoldingsLocation, field.ValueCount())
+	for i := range result {
+		result[i] = HoldingsLocation{
+			field.GetNthSubfield("a", i),
+			field.GetNthSubfield("b", i),
+			field.GetNthSubfield("h", i),
+		}
+	}
+	return result
+}
+
+// A CaptionedValue is a single level of enumeration ($a -- $h) or chronology
+// ($i -- $m): the caption from an 853 and the value from its 863.
+type CaptionedValue struct {
+	Code    string
+	Caption string
+	Value   string
+}
+
+// A HoldingsIssue is an 863 enumeration and chronology paired with the
+// captions of the 853 it is linked to.
+type HoldingsIssue struct {
+	Link   string // the 863 $8, "link.sequence"
+	Levels []CaptionedValue
+}
+
+// enumerationCodes are the enumeration and chronology subfield codes shared
+// by the 853 and 863.
+const enumerationCodes = "abcdefghijklm"
+
+// EnumerationChronology pairs each 863 of a holdings record with the 853
+// whose $8 link number matches the part of the 863 $8 before the ".". It
+// returns nil if the record is not a holdings record.
+func (m *MarcRecord) EnumerationChronology() []HoldingsIssue {
+	if !m.IsHoldings() {
+		return nil
+	}
+
+	captions := m.GetRawField("853")
+	byLink := make(map[string]int)
+	for i := 0; i < captions.ValueCount(); i++ {
+		byLink[captions.GetNthSubfield("8", i)] = i
+	}
+
+	values := m.GetRawField("863")
+	result := make([]HoldingsIssue, 0, values.ValueCount())
+	for i := 0; i < values.ValueCount(); i++ {
+		link := values.GetNthSubfield("8", i)
+		linkNumber := link
+		if dot := strings.IndexByte(link, '.'); dot != -1 {
+			linkNumber = link[:dot]
+		}
+		c, hasCaptions := byLink[linkNumber]
+
+		issue := HoldingsIssue{link, make([]CaptionedValue, 0)}
+		for _, code := range enumerationCodes {
+			value := values.GetNthRawSubfield(string(code), i)
+			if value == nil {
+				continue
+			}
+			caption := ""
+			if hasCaptions {
+				caption = captions.GetNthSubfield(string(code), c)
+			}
+			v, _ := values.transcoder(value)
+			issue.Levels = append(issue.Levels, CaptionedValue{string(code), caption, v})
+		}
+		result = append(result, issue)
+	}
+	return result
+}
@@ -0,0 +1,59 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"testing"
+)
+
+func TestHoldings(t *testing.T) {
+	m, err := NewRecordBuilder().
+		SetLeader("00000nx  a2200000un 4500").
+		AddControlField("001", "hold-1").
+		AddDataField("852", '0', '1', Subfield{"a", "MH"}, Subfield{"b", "Widener"}, Subfield{"h", "QK1 .B6"}).
+		AddDataField("853", '2', '0', Subfield{"8", "1"}, Subfield{"a", "v."}, Subfield{"b", "no."}, Subfield{"i", "(year)"}).
+		AddDataField("853", '2', '0', Subfield{"8", "2"}, Subfield{"a", "suppl."}).
+		AddDataField("863", '4', '0', Subfield{"8", "1.1"}, Subfield{"a", "12"}, Subfield{"b", "3"}, Subfield{"i", "1937"}).
+		AddDataField("863", '4', '0', Subfield{"8", "2.1"}, Subfield{"a", "1"}).
+		Build()
+	if err != nil {
+		t.Fatalf("Unable to build holdings record: %v", err)
+	}
+
+	locs := m.HoldingsLocations()
+	if len(locs) != 1 || locs[0].Sublocation != "Widener" || locs[0].Classification != "QK1 .B6" {
+		t.Errorf("852 location is wrong: %v", locs)
+	}
+
+	issues := m.EnumerationChronology()
+	if len(issues) != 2 {
+		t.Fatalf("Expected 2 issues, got %d", len(issues))
+	}
+	levels := issues[0].Levels
+	if issues[0].Link != "1.1" || len(levels) != 3 {
+		t.Fatalf("First issue is wrong: %v", issues[0])
+	}
+	if levels[0] != (CaptionedValue{"a", "v.", "12"}) || levels[2] != (CaptionedValue{"i", "(year)", "1937"}) {
+		t.Errorf("First issue levels are wrong: %v", levels)
+	}
+	if l := issues[1].Levels; len(l) != 1 || l[0].Caption != "suppl." {
+		t.Errorf("Second issue should use the second 853: %v", l)
+	}
+
+	bib, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	if bib.HoldingsLocations() != nil || bib.EnumerationChronology() != nil {
+		t.Errorf("Bibliographic record should have no holdings")
+	}
+}
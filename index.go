@@ -0,0 +1,115 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// indexMagic begins an index written by WriteIndex; the final byte is the
+// format version.
+const indexMagic = "MRCX\x01"
+
+var errBadIndex = errors.New("marc21: not a record index")
+
+// BuildIndex reads every record from r and returns a map from each record's
+// control number (001) to its offset, for use with MappedFile.RecordAt.
+// Records without an 001 are left out. If a control number repeats, the
+// first record with it is indexed.
+func BuildIndex(r io.Reader) (map[string]uint64, error) {
+	idx := make(map[string]uint64)
+	for m, err := range NewReader(r, false).All() {
+		if err != nil {
+			return nil, err
+		}
+		id, err := m.GetControlField("001")
+		if err != nil || id == "" {
+			continue
+		}
+		if _, ok := idx[id]; !ok {
+			idx[id] = m.Offset
+		}
+	}
+	return idx, nil
+}
+
+// WriteIndex writes idx to w in a compact binary form read by ReadIndex: a
+// short header, then each control number and offset as varint-prefixed bytes
+// and a uvarint, sorted by control number.
+func WriteIndex(w io.Writer, idx map[string]uint64) error {
+	ids := make([]string, 0, len(idx))
+	for id := range idx {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(indexMagic)
+	buf := make([]byte, binary.MaxVarintLen64)
+	bw.Write(buf[:binary.PutUvarint(buf, uint64(len(ids)))])
+	for _, id := range ids {
+		bw.Write(buf[:binary.PutUvarint(buf, uint64(len(id)))])
+		bw.WriteString(id)
+		bw.Write(buf[:binary.PutUvarint(buf, idx[id])])
+	}
+	return bw.Flush()
+}
+
+// ReadIndex reads an index written by WriteIndex.
+func ReadIndex(r io.Reader) (map[string]uint64, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(indexMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != indexMagic {
+		return nil, errBadIndex
+	}
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("marc21: reading index: %w", noEOF(err))
+	}
+
+	idx := make(map[string]uint64)
+	for i := uint64(0); i < n; i++ {
+		size, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, fmt.Errorf("marc21: reading index: %w", noEOF(err))
+		}
+		if size > maxRecordSize {
+			return nil, errBadIndex
+		}
+		id := make([]byte, size)
+		if _, err := io.ReadFull(br, id); err != nil {
+			return nil, fmt.Errorf("marc21: reading index: %w", noEOF(err))
+		}
+		offset, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, fmt.Errorf("marc21: reading index: %w", noEOF(err))
+		}
+		idx[string(id)] = offset
+	}
+	return idx, nil
+}
+
+// noEOF reports a premature end of the index as io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
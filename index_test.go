@@ -0,0 +1,47 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	idx, err := BuildIndex(strings.NewReader(fullRecord + "\n" + otherRecord))
+	if err != nil {
+		t.Fatalf("Unable to build index: %v", err)
+	}
+	if len(idx) != 2 || idx["000000002-7"] != 0 || idx["000000003-7"] != uint64(fullRecordLen+1) {
+		t.Fatalf("Index is %v, expected offsets 0 and %d", idx, fullRecordLen+1)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteIndex(&buf, idx); err != nil {
+		t.Fatalf("Unable to write index: %v", err)
+	}
+	read, err := ReadIndex(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Unable to read index: %v", err)
+	}
+	if len(read) != 2 || read["000000002-7"] != 0 || read["000000003-7"] != uint64(fullRecordLen+1) {
+		t.Errorf("Index read back as %v", read)
+	}
+
+	if _, err := ReadIndex(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err == nil {
+		t.Errorf("Truncated index was read without error")
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// jsonDataField is the MARC-in-JSON representation of a data field.
+type jsonDataField struct {
+	Subfields []map[string]string `json:"subfields"`
+	Ind1      string              `json:"ind1"`
+	Ind2      string              `json:"ind2"`
+}
+
+// jsonRecord is the MARC-in-JSON representation of a record.
+type jsonRecord struct {
+	Leader string                   `json:"leader"`
+	Fields []map[string]interface{} `json:"fields"`
+}
+
+// MarshalJSON encodes the record as MARC-in-JSON, with the fields in
+// directory order.
+func (m *MarcRecord) MarshalJSON() ([]byte, error) {
+	rec := jsonRecord{m.GetLeader(), make([]map[string]interface{}, 0)}
+
+	_, ft := m.delims.get()
+	entries, _ := decodeEntries(m.RawRecord)
+	for _, e := range entries {
+		// the data of a corrupt record may be too short for indicators or
+		// lack its terminator
+		data := m.RawRecord[e.offset : e.offset+e.length]
+		if len(data) > 0 && data[len(data)-1] == ft {
+			data = data[:len(data)-1]
+		}
+		if IsControlFieldTag(e.tag) {
+			value, err := m.transcoder(data)
+			if err != nil {
+				return nil, err
+			}
+			rec.Fields = append(rec.Fields, map[string]interface{}{e.tag: value})
+			continue
+		}
+
+		ind := []byte{IndicatorBlank, IndicatorBlank}
+		copy(ind, data)
+		df := jsonDataField{make([]map[string]string, 0), string(ind[0]), string(ind[1])}
+		if len(data) <= 2 {
+			rec.Fields = append(rec.Fields, map[string]interface{}{e.tag: df})
+			continue
+		}
+		for _, sf := range subfieldChunks(append(data[2:len(data):len(data)], ft), m.delims) {
+			value, err := m.transcoder(sf[1:])
+			if err != nil {
+				return nil, err
+			}
+			df.Subfields = append(df.Subfields, map[string]string{string(sf[0]): value})
+		}
+		rec.Fields = append(rec.Fields, map[string]interface{}{e.tag: df})
+	}
+
+	return json.Marshal(rec)
+}
+
+// A JSONArrayWriter streams records to an io.Writer as a JSON array of
+// MARC-in-JSON records, without holding more than one record in memory.
+type JSONArrayWriter struct {
+	w     io.Writer
+	count int
+}
+
+// flusher is implemented by buffered writers such as bufio.Writer.
+type flusher interface {
+	Flush() error
+}
+
+func NewJSONArrayWriter(w io.Writer) *JSONArrayWriter {
+	return &JSONArrayWriter{w: w}
+}
+
+// Write appends a record to the array. If the underlying writer can be
+// flushed it is flushed after each record.
+func (j *JSONArrayWriter) Write(m *MarcRecord) error {
+	data, err := m.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	sep := ","
+	if j.count == 0 {
+		sep = "["
+	}
+	if _, err = io.WriteString(j.w, sep); err != nil {
+		return err
+	}
+	if _, err = j.w.Write(data); err != nil {
+		return err
+	}
+	j.count++
+
+	if f, ok := j.w.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Close terminates the array. It does not close the underlying writer.
+func (j *JSONArrayWriter) Close() error {
+	end := "]"
+	if j.count == 0 {
+		end = "[]"
+	}
+	if _, err := io.WriteString(j.w, end); err != nil {
+		return err
+	}
+	if f, ok := j.w.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
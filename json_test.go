@@ -0,0 +1,101 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSONArrayWriter(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+
+	var buf bytes.Buffer
+	w := NewJSONArrayWriter(&buf)
+	for i := 0; i < 2; i++ {
+		if err := w.Write(m); err != nil {
+			t.Fatalf("Unable to write record: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Unable to close writer: %v", err)
+	}
+
+	var records []jsonRecord
+	if err := json.NewDecoder(&buf).Decode(&records); err != nil {
+		t.Fatalf("Output is not a valid JSON array: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Array should have 2 records, got %d", len(records))
+	}
+	for i := range records {
+		if records[i].Leader != m.GetLeader() {
+			t.Errorf("Record %d leader is wrong: %v", i, records[i].Leader)
+		}
+		if len(records[i].Fields) != 11 {
+			t.Errorf("Record %d should have 11 fields, got %d", i, len(records[i].Fields))
+		}
+	}
+
+	title := records[0].Fields[4]["245"].(map[string]interface{})
+	sf := title["subfields"].([]interface{})[0].(map[string]interface{})
+	if sf["a"] != "Garden exhibition /" {
+		t.Errorf("245$a did not round-trip: %v", sf["a"])
+	}
+}
+
+func TestJSONArrayWriterEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewJSONArrayWriter(&buf)
+	w.Close()
+	if buf.String() != "[]" {
+		t.Errorf("Empty array should be \"[]\", got %v", buf.String())
+	}
+}
+
+func TestMarshalJSONCorruptFields(t *testing.T) {
+	// the 001 directory entry with its length zeroed, and a 245 cut short
+	// after its first indicator
+	corrupt := strings.Replace(fullRecord, "001001200000", "001000000000", 1)
+	corrupt = strings.Replace(corrupt, "245005400086", "245000100086", 1)
+	m, err := NewMarcRecord([]byte(corrupt), false, 0)
+	if err != nil {
+		t.Fatalf("Unable to parse record: %v", err)
+	}
+	data, err := m.MarshalJSON()
+	if err != nil {
+		t.Fatalf("Unable to marshal corrupt record: %v", err)
+	}
+	if !strings.Contains(string(data), `{"001":""}`) || !strings.Contains(string(data), `{"245":{"subfields":[],"ind1":"0","ind2":" "}}`) {
+		t.Errorf("Corrupt fields marshaled wrongly: %s", data)
+	}
+}
+
+func TestMarshalJSONCustomDelimiter(t *testing.T) {
+	dollar := strings.Replace(fullRecord, "\x1f", "$", -1)
+	m, err := NewReaderWithPolicy(strings.NewReader(dollar), Policy{SubfieldDelimiter: '$'}).Next()
+	if err != nil {
+		t.Fatalf("Unable to read record: %v", err)
+	}
+	data, err := m.MarshalJSON()
+	if err != nil {
+		t.Fatalf("Unable to marshal record: %v", err)
+	}
+	if !strings.Contains(string(data), `{"245":{"subfields":[{"a":"Garden exhibition /"},{"c":"San Francisco Museum of Art."}],"ind1":"0","ind2":"0"}}`) {
+		t.Errorf("Subfields should be split on the policy delimiter: %s", data)
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"unicode/utf8"
+)
+
+// A RecordStatus is the value of leader position 05.
+type RecordStatus byte
+
+const (
+	StatusIncreasedLevel  RecordStatus = 'a'
+	StatusCorrected       RecordStatus = 'c'
+	StatusDeleted         RecordStatus = 'd'
+	StatusNew             RecordStatus = 'n'
+	StatusIncreasedPrepub RecordStatus = 'p'
+)
+
+func (s RecordStatus) String() string {
+	switch s {
+	case StatusIncreasedLevel:
+		return "Increase in encoding level"
+	case StatusCorrected:
+		return "Corrected or revised"
+	case StatusDeleted:
+		return "Deleted"
+	case StatusNew:
+		return "New"
+	case StatusIncreasedPrepub:
+		return "Increase in encoding level from prepublication"
+	}
+	return "Unknown"
+}
+
+// RecordStatus returns the record status from leader position 05. (The raw
+// byte remains available as m.Status.)
+func (m *MarcRecord) RecordStatus() RecordStatus {
+	return RecordStatus(m.Status)
+}
+
+// IsDeleted reports whether the record is marked as deleted.
+func (m *MarcRecord) IsDeleted() bool {
+	return m.RecordStatus() == StatusDeleted
+}
+
+// EncodingLevelName returns the name of the encoding level in leader
+// position 17.
+func (m *MarcRecord) EncodingLevelName() string {
+	switch m.EncodingLevel {
+	case ' ':
+		return "Full level"
+	case '1':
+		return "Full level, material not examined"
+	case '2':
+		return "Less-than-full level, material not examined"
+	case '3':
+		return "Abbreviated level"
+	case '4':
+		return "Core level"
+	case '5':
+		return "Partial (preliminary) level"
+	case '7':
+		return "Minimal level"
+	case '8':
+		return "Prepublication level"
+	case 'u':
+		return "Unknown"
+	case 'z':
+		return "Not applicable"
+	}
+	return "Invalid"
+}
+
+// IsFullLevel reports whether the record is cataloged at full level, with or
+// without the material having been examined.
+func (m *MarcRecord) IsFullLevel() bool {
+	return m.EncodingLevel == ' ' || m.EncodingLevel == '1'
+}
+
+// A RecordType is the value of leader position 06.
+type RecordType byte
+
+const (
+	TypeLanguageMaterial           RecordType = 'a'
+	TypeNotatedMusic               RecordType = 'c'
+	TypeManuscriptNotatedMusic     RecordType = 'd'
+	TypeCartographic               RecordType = 'e'
+	TypeManuscriptCartographic     RecordType = 'f'
+	TypeProjectedMedium            RecordType = 'g'
+	TypeNonmusicalSoundRecording   RecordType = 'i'
+	TypeMusicalSoundRecording      RecordType = 'j'
+	TypeTwoDimensionalGraphic      RecordType = 'k'
+	TypeComputerFile               RecordType = 'm'
+	TypeKit                        RecordType = 'o'
+	TypeMixedMaterials             RecordType = 'p'
+	TypeThreeDimensionalArtifact   RecordType = 'r'
+	TypeManuscriptLanguageMaterial RecordType = 't'
+)
+
+func (t RecordType) String() string {
+	switch t {
+	case TypeLanguageMaterial:
+		return "Language material"
+	case TypeNotatedMusic:
+		return "Notated music"
+	case TypeManuscriptNotatedMusic:
+		return "Manuscript notated music"
+	case TypeCartographic:
+		return "Cartographic material"
+	case TypeManuscriptCartographic:
+		return "Manuscript cartographic material"
+	case TypeProjectedMedium:
+		return "Projected medium"
+	case TypeNonmusicalSoundRecording:
+		return "Nonmusical sound recording"
+	case TypeMusicalSoundRecording:
+		return "Musical sound recording"
+	case TypeTwoDimensionalGraphic:
+		return "Two-dimensional nonprojectable graphic"
+	case TypeComputerFile:
+		return "Computer file"
+	case TypeKit:
+		return "Kit"
+	case TypeMixedMaterials:
+		return "Mixed materials"
+	case TypeThreeDimensionalArtifact:
+		return "Three-dimensional artifact or naturally occurring object"
+	case TypeManuscriptLanguageMaterial:
+		return "Manuscript language material"
+	}
+	return "Unknown"
+}
+
+// IsTextual reports whether the type is language material, printed or
+// manuscript.
+func (t RecordType) IsTextual() bool {
+	return t == TypeLanguageMaterial || t == TypeManuscriptLanguageMaterial
+}
+
+// IsManuscript reports whether the type is manuscript material.
+func (t RecordType) IsManuscript() bool {
+	switch t {
+	case TypeManuscriptNotatedMusic, TypeManuscriptCartographic, TypeManuscriptLanguageMaterial:
+		return true
+	}
+	return false
+}
+
+// IsSoundRecording reports whether the type is a musical or nonmusical sound
+// recording.
+func (t RecordType) IsSoundRecording() bool {
+	return t == TypeNonmusicalSoundRecording || t == TypeMusicalSoundRecording
+}
+
+// RecordType returns the type of record from leader position 06. (The raw
+// byte remains available as m.Type.)
+func (m *MarcRecord) RecordType() RecordType {
+	return RecordType(m.Type)
+}
+
+// A DescriptiveCatalogingForm is the value of leader position 18.
+type DescriptiveCatalogingForm byte
+
+const (
+	FormNonISBD                   DescriptiveCatalogingForm = ' '
+	FormAACR2                     DescriptiveCatalogingForm = 'a'
+	FormISBDPunctuationOmitted    DescriptiveCatalogingForm = 'c'
+	FormISBDPunctuationIncluded   DescriptiveCatalogingForm = 'i'
+	FormNonISBDPunctuationOmitted DescriptiveCatalogingForm = 'n'
+	FormUnknown                   DescriptiveCatalogingForm = 'u'
+)
+
+func (f DescriptiveCatalogingForm) String() string {
+	switch f {
+	case FormNonISBD:
+		return "Non-ISBD"
+	case FormAACR2:
+		return "AACR 2"
+	case FormISBDPunctuationOmitted:
+		return "ISBD punctuation omitted"
+	case FormISBDPunctuationIncluded:
+		return "ISBD punctuation included"
+	case FormNonISBDPunctuationOmitted:
+		return "Non-ISBD punctuation omitted"
+	case FormUnknown:
+		return "Unknown"
+	}
+	return "Invalid"
+}
+
+// DescriptiveCatalogingForm returns the descriptive cataloging form from
+// leader position 18.
+func (m *MarcRecord) DescriptiveCatalogingForm() DescriptiveCatalogingForm {
+	return DescriptiveCatalogingForm(m.CatalogingForm)
+}
+
+// A MultipartResourceLevel is the value of leader position 19.
+type MultipartResourceLevel byte
+
+const (
+	MultipartNotSpecified     MultipartResourceLevel = ' '
+	MultipartSet              MultipartResourceLevel = 'a'
+	MultipartIndependentTitle MultipartResourceLevel = 'b'
+	MultipartDependentTitle   MultipartResourceLevel = 'c'
+)
+
+func (l MultipartResourceLevel) String() string {
+	switch l {
+	case MultipartNotSpecified:
+		return "Not specified or not applicable"
+	case MultipartSet:
+		return "Set"
+	case MultipartIndependentTitle:
+		return "Part with independent title"
+	case MultipartDependentTitle:
+		return "Part with dependent title"
+	}
+	return "Invalid"
+}
+
+// MultipartResourceLevel returns the multipart resource record level from
+// leader position 19.
+func (m *MarcRecord) MultipartResourceLevel() MultipartResourceLevel {
+	return MultipartResourceLevel(m.MultipartLevel)
+}
+
+// EncodingConsistent reports whether the character coding scheme in leader
+// position 09 is one MARC 21 defines and agrees with the record's data. A
+// record declared UTF-8 ('a') must be valid UTF-8 without MARC-8 escape
+// sequences; one declared MARC-8 (' ') whose non-ASCII data is all valid
+// UTF-8 was most likely converted without its leader being updated. Either
+// would be transcoded wrongly.
+func (m *MarcRecord) EncodingConsistent() bool {
+	data := m.RawRecord[leaderSize:]
+	switch Encoding(m.CharacterEncoding) {
+	case UTF8:
+		return detectEncoding(data) == UTF8
+	case MARC8:
+		return !hasNonASCII(data) || detectEncoding(data) == MARC8
+	}
+	return false
+}
+
+func hasNonASCII(data []byte) bool {
+	for _, c := range data {
+		if c >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// HasValidUTF8 reports whether the field data of a record whose coding
+// scheme, leader position 09, is UTF-8 is valid UTF-8, to catch records
+// damaged by a bad conversion. Records in any other encoding always report
+// true.
+func (m *MarcRecord) HasValidUTF8() bool {
+	if Encoding(m.CharacterEncoding) != UTF8 {
+		return true
+	}
+	entries, _ := decodeEntries(m.RawRecord)
+	for _, e := range entries {
+		if !utf8.Valid(m.RawRecord[e.offset : e.offset+e.length]) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetStatus sets the record status, leader position 05, editing RawRecord in
+// place. Since the status does not affect the record length or directory the
+// record is not reserialized; note that a RawRecord aliasing a caller's
+// buffer (see ParseAll) is changed too.
+func (m *MarcRecord) SetStatus(status byte) {
+	m.RawRecord[5] = status
+	m.Status = status
+	m.modified = true
+}
+
+// SetLeader replaces the leader and reserializes the record. Whatever leader
+// holds in the computed positions, the record length (00-04), base address
+// (12-16) and entry map (20-23), is ignored. If validate is set every other
+// position is validated as by a validating Reader, and on failure a
+// *LeaderError is returned and the record is left unchanged; otherwise any
+// values are accepted, as for a leader a local Policy.LeaderRules allows.
+// The record keeps the transcoder and delimiters it was read with, so its
+// values decode as before, even if the character coding in position 09 is
+// changed.
+func (m *MarcRecord) SetLeader(leader [leaderSize]byte, validate bool) error {
+	raw, err := encodeRecord(leader[:], m.rawFields())
+	if err != nil {
+		return err
+	}
+	if validate {
+		if err := checkLeader(raw); err != nil {
+			return err
+		}
+	}
+	n, err := NewMarcRecord(raw, false, m.Offset)
+	if err != nil {
+		return err
+	}
+	m.RawRecord, m.Directory = n.RawRecord, n.Directory
+	m.Status, m.Type, m.BibLevel, m.CharacterEncoding = n.Status, n.Type, n.BibLevel, n.CharacterEncoding
+	m.EncodingLevel, m.CatalogingForm, m.MultipartLevel = n.EncodingLevel, n.CatalogingForm, n.MultipartLevel
+	m.dirty, m.modified = true, true
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRecordStatus(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+
+	if m.IsDeleted() {
+		t.Errorf("Record with status 'n' reported as deleted")
+	}
+	if s := m.RecordStatus(); s != StatusNew {
+		t.Errorf("Record status should be StatusNew, got %v", s)
+	}
+	if s := m.RecordStatus().String(); s != "New" {
+		t.Errorf("Record status name should be \"New\", got %v", s)
+	}
+}
+
+func TestRecordType(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+
+	if rt := m.RecordType(); rt != TypeLanguageMaterial {
+		t.Errorf("Record type should be TypeLanguageMaterial, got %q", byte(rt))
+	}
+	if s := m.RecordType().String(); s != "Language material" {
+		t.Errorf("Record type name should be \"Language material\", got %v", s)
+	}
+	if !m.RecordType().IsTextual() || TypeCartographic.IsTextual() {
+		t.Errorf("IsTextual is wrong")
+	}
+}
+
+func TestCatalogingFormAndMultipartLevel(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+
+	if f := m.DescriptiveCatalogingForm(); f != FormUnknown {
+		t.Errorf("Cataloging form should be FormUnknown, got %q", byte(f))
+	}
+	if s := m.DescriptiveCatalogingForm().String(); s != "Unknown" {
+		t.Errorf("Cataloging form name should be \"Unknown\", got %v", s)
+	}
+	if s := m.MultipartResourceLevel().String(); s != "Not specified or not applicable" {
+		t.Errorf("Multipart level name is wrong: %v", s)
+	}
+	if s := FormAACR2.String(); s != "AACR 2" {
+		t.Errorf("FormAACR2 name is wrong: %v", s)
+	}
+}
+
+func TestEncodingConsistent(t *testing.T) {
+	utf := strings.Replace(fullRecord, "Garden", "Gard\xc3\xb1", 1)
+	marc8 := strings.Replace(fullRecord[:9]+" "+fullRecord[10:], "Garden", "Gard\xe2n", 1)
+
+	for _, rec := range []string{fullRecord, fullRecord[:9] + " " + fullRecord[10:], utf, marc8} {
+		m, _ := NewMarcRecord([]byte(rec), true, 0)
+		if !m.EncodingConsistent() {
+			t.Errorf("Record with 09 %q should be consistent", rec[9])
+		}
+	}
+
+	// UTF-8 labeled MARC-8, and MARC-8 labeled UTF-8
+	mislabeled := []string{utf[:9] + " " + utf[10:], marc8[:9] + "a" + marc8[10:]}
+	for _, rec := range mislabeled {
+		m, _ := NewMarcRecord([]byte(rec), true, 0)
+		if m.EncodingConsistent() {
+			t.Errorf("Record with 09 %q should be inconsistent", rec[9])
+		}
+	}
+
+	r := NewReader(strings.NewReader(mislabeled[0]+fullRecord), true)
+	r.RequireConsistentEncoding(true)
+	var le *LeaderError
+	if _, err := r.Next(); !errors.As(err, &le) || len(le.Positions) != 1 || le.Positions[0] != 9 {
+		t.Errorf("Inconsistent record should be rejected, got %v", err)
+	}
+	if m, err := r.Next(); err != nil || m == nil {
+		t.Errorf("Consistent record should be accepted, got %v", err)
+	}
+}
+
+func TestEncodingLevelName(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+	if name := m.EncodingLevelName(); name != "Minimal level" {
+		t.Errorf("Encoding level '7' should be minimal, got %q", name)
+	}
+	if m.IsFullLevel() {
+		t.Errorf("Minimal level record should not be full level")
+	}
+
+	m.EncodingLevel = ' '
+	if !m.IsFullLevel() || m.EncodingLevelName() != "Full level" {
+		t.Errorf("Blank encoding level should be full level")
+	}
+}
+
+func TestSetStatus(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+	m.SetStatus('d')
+
+	if !m.IsDeleted() {
+		t.Errorf("Record should be deleted after SetStatus('d')")
+	}
+	if m.RawRecord[5] != 'd' {
+		t.Errorf("Raw leader byte was not updated: %q", m.RawRecord[5])
+	}
+	if _, err := NewMarcRecord(m.RawRecord, true, 0); err != nil {
+		t.Errorf("Updated record does not parse: %v", err)
+	}
+}
+
+func TestSetLeader(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+
+	var leader [leaderSize]byte
+	copy(leader[:], "99999cem a2299999 i 0000")
+	if err := m.SetLeader(leader, true); err != nil {
+		t.Fatalf("Unable to set leader: %v", err)
+	}
+	if m.RecordStatus() != StatusCorrected || m.Type != 'e' || m.DescriptiveCatalogingForm() != FormISBDPunctuationIncluded {
+		t.Errorf("Record does not reflect the new leader: %q", m.GetLeader())
+	}
+	if m.GetLeader() != "00458cem a2200157 i 4500" {
+		t.Errorf("Computed leader positions are wrong: %q", m.GetLeader())
+	}
+	if _, err := NewMarcRecord(m.RawRecord, true, 0); err != nil {
+		t.Errorf("Record with the new leader does not parse: %v", err)
+	}
+
+	copy(leader[:], "99999xem a2299999 i 0000")
+	var le *LeaderError
+	if err := m.SetLeader(leader, true); !errors.As(err, &le) || le.Positions[0] != 5 {
+		t.Errorf("Invalid leader should be rejected, got %v", err)
+	}
+	if m.Status != 'c' {
+		t.Errorf("Rejected leader should leave the record unchanged")
+	}
+
+	// a non-standard leader is accepted without validation
+	if err := m.SetLeader(leader, false); err != nil || m.Status != 'x' {
+		t.Errorf("Unvalidated leader should be accepted, got %v", err)
+	}
+}
+
+func TestSetLeaderKeepsReaderOptions(t *testing.T) {
+	spaced := strings.Replace(fullRecord, "Garden exhibition /", " Garden  exhibition", 1)
+	r := NewReader(strings.NewReader(spaced), false)
+	r.CollapseWhitespace(true)
+	m, _ := r.Next()
+
+	var leader [leaderSize]byte
+	copy(leader[:], m.GetLeader())
+	leader[5] = 'c'
+	if err := m.SetLeader(leader, true); err != nil {
+		t.Fatalf("Unable to set leader: %v", err)
+	}
+	if v := m.GetSubfield("245", "a"); v != "Garden exhibition" {
+		t.Errorf("Values should still be collapsed after SetLeader, got %q", v)
+	}
+}
+
+func TestHasValidUTF8(t *testing.T) {
+	// fullRecord has the usual UTF-8 leader, with 08 blank and 09 'a'
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+	if !m.HasValidUTF8() {
+		t.Errorf("ASCII record labeled UTF-8 should be valid")
+	}
+
+	// a lone continuation byte, the same length as the character it replaces
+	corrupt := strings.Replace(fullRecord, "Garden", "Gard\x80n", 1)
+	m, _ = NewMarcRecord([]byte(corrupt), true, 0)
+	if m.HasValidUTF8() {
+		t.Errorf("Record with an invalid byte sequence should not be valid")
+	}
+
+	marc8 := corrupt[:9] + " " + corrupt[10:]
+	m, _ = NewMarcRecord([]byte(marc8), true, 0)
+	if !m.HasValidUTF8() {
+		t.Errorf("MARC-8 record should report valid UTF-8")
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// A MappedFile gives random access to the records of a file that is mapped
+// into memory rather than read, so a record can be parsed directly from the
+// mapping by its Offset. Where memory mapping is unavailable the file is read
+// into memory instead.
+type MappedFile struct {
+	data    []byte
+	offsets []uint64
+}
+
+// OpenFile maps the file at path into memory. The MappedFile must be closed
+// when no longer needed; records returned by RecordAt alias the mapping and
+// must not be used after Close.
+func OpenFile(path string) (*MappedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		return &MappedFile{}, nil
+	}
+	if int64(int(fi.Size())) != fi.Size() {
+		return nil, fmt.Errorf("marc21: %s is too large to map", path)
+	}
+	data, err := mmap(f, int(fi.Size()))
+	if err != nil {
+		return nil, err
+	}
+	return &MappedFile{data: data}, nil
+}
+
+// Close unmaps the file.
+func (mf *MappedFile) Close() error {
+	data := mf.data
+	mf.data, mf.offsets = nil, nil
+	if data == nil {
+		return nil
+	}
+	return munmap(data)
+}
+
+// Len returns the size of the file in bytes.
+func (mf *MappedFile) Len() int {
+	return len(mf.data)
+}
+
+// RecordAt parses the record starting at offset, as given by the Offset of a
+// record read from the same file. The leader is not validated. The record is
+// not copied: its RawRecord aliases the mapping.
+func (mf *MappedFile) RecordAt(offset uint64) (*MarcRecord, error) {
+	raw, err := mf.rawRecordAt(offset)
+	if err != nil {
+		return nil, err
+	}
+	return NewMarcRecord(raw, false, offset)
+}
+
+func (mf *MappedFile) rawRecordAt(offset uint64) ([]byte, error) {
+	if offset > uint64(len(mf.data)) || uint64(len(mf.data))-offset < 5 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := mf.data[offset:]
+	rlen, err := DecodeDecimal(data[:5])
+	if err != nil || rlen < leaderSize+2 || rlen > maxRecordSize {
+		return nil, errInvalidLength
+	}
+	if len(data) < rlen {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if data[rlen-1] != recordTerminator {
+		return nil, errNoRecordTerminator
+	}
+	return data[:rlen:rlen], nil
+}
+
+// Offsets returns the offset of every record in the file, in order, skipping
+// whitespace between records as Reader does. The index is built by walking
+// the record lengths on the first call and remembered for later ones.
+func (mf *MappedFile) Offsets() ([]uint64, error) {
+	if mf.offsets != nil {
+		return mf.offsets, nil
+	}
+	offsets := make([]uint64, 0)
+	offset := 0
+	for {
+		for offset < len(mf.data) && isRecordSpace(mf.data[offset]) {
+			offset++
+		}
+		if offset == len(mf.data) {
+			break
+		}
+		raw, err := mf.rawRecordAt(uint64(offset))
+		if err != nil {
+			return nil, fmt.Errorf("marc21: record at offset %d: %w", offset, err)
+		}
+		offsets = append(offsets, uint64(offset))
+		offset += len(raw)
+	}
+	mf.offsets = offsets
+	return offsets, nil
+}
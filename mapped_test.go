@@ -0,0 +1,58 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMappedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.mrc")
+	if err := os.WriteFile(path, []byte(fullRecord+"\n"+otherRecord), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(strings.NewReader(fullRecord+"\n"+otherRecord), true)
+	r.Next()
+	second, _ := r.Next()
+
+	mf, err := OpenFile(path)
+	if err != nil {
+		t.Fatalf("Unable to map file: %v", err)
+	}
+	defer mf.Close()
+
+	offsets, err := mf.Offsets()
+	if err != nil {
+		t.Fatalf("Unable to index file: %v", err)
+	}
+	if len(offsets) != 2 || offsets[0] != 0 || offsets[1] != second.Offset {
+		t.Fatalf("Offsets are %v, expected [0 %d]", offsets, second.Offset)
+	}
+
+	m, err := mf.RecordAt(second.Offset)
+	if err != nil {
+		t.Fatalf("Unable to read record at %d: %v", second.Offset, err)
+	}
+	if id, _ := m.GetControlField("001"); id != "000000003-7" {
+		t.Errorf("Record at %d has 001 %q, expected 000000003-7", second.Offset, id)
+	}
+	if _, err := mf.RecordAt(second.Offset + 1); err == nil {
+		t.Errorf("RecordAt succeeded at an offset inside a record")
+	}
+}
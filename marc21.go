@@ -16,18 +16,28 @@
 package marc21
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"sort"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 var (
 	errInvalidLength      = errors.New("marc21: record length is invalid")
 	errNoRecordTerminator = errors.New("marc21: record must end in a RT")
-	errInvalidLeader      = errors.New("marc21: leader is invalid")
+
+	errInvalidBaseAddress    = errors.New("marc21: base address of data is invalid")
+	errNoDirectoryTerminator = errors.New("marc21: directory must end in a FT")
+	errDirectoryTruncated    = errors.New("marc21: directory is truncated")
+	errInvalidDirectory      = errors.New("marc21: directory entry is invalid")
 )
 
 const (
@@ -41,10 +51,14 @@ const (
 	maxRecordSize = 99999
 )
 
-// A transcoder transcodes a slice into a Unicode string.
-type transcoderFunc func(bytes []byte) (string, error)
+// A Transcoder transcodes a slice into a Unicode string.
+type Transcoder func(bytes []byte) (string, error)
 
 // FIXME: location is not a good name for this
+//
+// A location is where a field's data lies in the raw record. The offset is
+// absolute, i.e. the base address plus the starting character position that
+// the directory records; it can be used to slice RawRecord directly.
 type location struct {
 	offset int
 	length int
@@ -53,27 +67,124 @@ type location struct {
 type VariableField struct {
 	Tag        string
 	rawData    [][]byte
-	transcoder transcoderFunc
+	transcoder Transcoder
+	delims     delimiters
+}
+
+// delimiters are the subfield delimiter and field terminator a record's
+// subfields are parsed with. The zero value stands for the MARC 21 ones.
+type delimiters struct {
+	subfield, field byte
+}
+
+// get returns the delimiter and terminator, applying the MARC 21 defaults.
+func (d delimiters) get() (byte, byte) {
+	sd, ft := d.subfield, d.field
+	if sd == 0 {
+		sd = delimiter
+	}
+	if ft == 0 {
+		ft = fieldTerminator
+	}
+	return sd, ft
 }
 
 type Reader struct {
-	r        io.Reader
-	validate bool
-	offset   uint64
+	r      *bufio.Reader
+	offset uint64
+	policy Policy
+	// sources opens each of the inputs after the current one, returning a
+	// closer if the Reader opened it (see multi.go).
+	sources     []func() (io.Reader, io.Closer, error)
+	closer      io.Closer
+	resetOffset bool
+	// limit is the number of records to read, or 0 for all of them, and
+	// count is the number read so far
+	limit int
+	count int
+	// started is set once the start of the current input has been checked
+	// for a byte-order mark
+	started bool
+}
+
+// A Policy configures how a Reader checks and normalizes the records it
+// reads. The zero Policy accepts any record that can be parsed.
+type Policy struct {
+	// ValidateLeader rejects records whose leader holds values the MARC 21
+	// rules do not allow, with a *LeaderError.
+	ValidateLeader bool
+	// LeaderRules adds to or overrides the MARC 21 leader rules applied by
+	// ValidateLeader, mapping a leader position to the values allowed
+	// there, e.g. {18: "i"} to require ISBD punctuation. An empty string
+	// removes the built-in rule for the position.
+	LeaderRules map[int]string
+	// ValidateDirectory rejects records whose directory, though it can be
+	// decoded, has a malformed tag, a field without its terminator, or
+	// overlapping fields (see checkDirectory).
+	ValidateDirectory bool
+	// RequiredSubfields rejects records whose data fields are missing
+	// required subfields, as reported by MarcRecord.ValidateFields.
+	RequiredSubfields map[string][]string
+	// RequireConsistentEncoding rejects records whose coding scheme, leader
+	// position 09, disagrees with their data (see
+	// MarcRecord.EncodingConsistent) with a *LeaderError.
+	RequireConsistentEncoding bool
+	// UnknownEncoding says how records with an unrecognized character
+	// encoding are decoded.
+	UnknownEncoding UnknownEncodingPolicy
+	// AllowMissingFinalTerminator accepts a last record lacking its record
+	// terminator if it is exactly one byte shorter than its declared length.
+	AllowMissingFinalTerminator bool
+	// CollapseWhitespace squeezes runs of spaces in decoded values (see
+	// CollapsingTranscoder).
+	CollapseWhitespace bool
+	// PadShortLeaders repairs records whose leader is short because the
+	// producer dropped trailing positions (see padLeader).
+	PadShortLeaders bool
+	// OverrunTolerance is the number of bytes by which a directory entry may
+	// claim a field extends past the end of the record data. Such a field
+	// is clamped to end at the record terminator (see clampOverruns); an
+	// entry overrunning by more is rejected as usual.
+	OverrunTolerance int
+	// RepairFieldTerminators replaces the last byte of every field that
+	// does not end in a field terminator with one (see
+	// MarcRecord.MisterminatedFields).
+	RepairFieldTerminators bool
+	// SubfieldDelimiter and FieldTerminator replace the MARC 21 subfield
+	// delimiter (0x1f) and field terminator (0x1e) in the subfield accessors
+	// of the records' fields, for non-standard records. Zero keeps the MARC
+	// 21 value. The directory, and the editing and serializing methods,
+	// always use the MARC 21 values.
+	SubfieldDelimiter byte
+	FieldTerminator   byte
 }
 
 type MarcRecord struct {
-	RawRecord         []byte
-	Offset            uint64
-	Status            byte
-	Type              byte
-	BibLevel          byte
+	RawRecord []byte
+	Offset    uint64
+	Status    byte
+	Type      byte
+	BibLevel  byte
+	// CharacterEncoding is the character coding scheme, leader position 09:
+	// ' ' for MARC-8 or 'a' for UTF-8.
 	CharacterEncoding byte
 	EncodingLevel     byte
 	CatalogingForm    byte
 	MultipartLevel    byte
 	Directory         map[string][]location
-	transcoder        transcoderFunc
+	transcoder        Transcoder
+	// decoder is the transcoder for the character encoding alone, without
+	// options such as CollapseWhitespace that change the decoded values. It
+	// is used when values are reencoded, so that they round trip exactly.
+	decoder Transcoder
+	// delims are given to the record's fields (see Policy.SubfieldDelimiter)
+	delims delimiters
+	// dirty is set by a mutation that changes the record's fields or
+	// leader structure, so that a Writer reserializes the record rather
+	// than copying RawRecord. modified is set by any mutation, including
+	// those, such as SetStatus, that patch RawRecord in place.
+	dirty    bool
+	modified bool
 	// The identifier length and indicator count are not stored because they
 	// are constant in MARC 21 (2 octets each).
 }
@@ -104,15 +215,76 @@ var marc21LeaderValues = []struct {
 }
 
 func NewReader(rdr io.Reader, validate bool) *Reader {
+	return NewReaderWithPolicy(rdr, Policy{ValidateLeader: validate})
+}
+
+// NewReaderWithPolicy returns a Reader that checks and normalizes records as
+// p directs. The Reader's option methods adjust the same settings.
+func NewReaderWithPolicy(rdr io.Reader, p Policy) *Reader {
 	nr := new(Reader)
-	nr.r = rdr
-	nr.validate = validate
+	nr.r = bufio.NewReader(rdr)
+	nr.policy = p
 	nr.offset = 0
 	return nr
 }
 
+// NewReaderAuto is like NewReader, but if rdr holds a gzip-compressed stream
+// (such as a .mrc.gz file) it is transparently decompressed.
+func NewReaderAuto(rdr io.Reader, validate bool) (*Reader, error) {
+	br := bufio.NewReader(rdr)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return NewReader(zr, validate), nil
+	}
+	return NewReader(br, validate), nil
+}
+
 func (r *Reader) Next() (*MarcRecord, error) {
-	rlen, raw, err := readRecord(r.r)
+	return r.each(r.next)
+}
+
+// each calls next until it returns a record or an error, advancing to the
+// next input of a multi-reader each time the current one is exhausted. Once
+// the Reader's limit is reached it returns no more records.
+func (r *Reader) each(next func() (*MarcRecord, error)) (*MarcRecord, error) {
+	if r.limit > 0 && r.count >= r.limit {
+		return nil, nil
+	}
+	for {
+		m, err := next()
+		if m != nil {
+			r.count++
+		}
+		if m != nil || err != nil || len(r.sources) == 0 {
+			if m == nil && err == nil {
+				return nil, r.Close()
+			}
+			return m, err
+		}
+		if err := r.advance(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *Reader) next() (*MarcRecord, error) {
+	r.skipBOM()
+	skipped, err := skipWhitespace(r.r)
+	r.offset += uint64(skipped)
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	rlen, raw, err := readRecord(r.r, r.offset, r.policy.AllowMissingFinalTerminator)
 	if err == io.EOF {
 		return nil, nil
 	} else if err != nil {
@@ -121,7 +293,149 @@ func (r *Reader) Next() (*MarcRecord, error) {
 	offset := r.offset
 	r.offset += uint64(rlen)
 
-	return NewMarcRecord(raw, r.validate, offset)
+	return r.parse(raw, offset)
+}
+
+// Limit sets the number of records to read: once n have been returned the
+// Reader behaves as if the stream had ended. A limit of 0, the default,
+// reads every record.
+func (r *Reader) Limit(n int) {
+	r.limit = n
+}
+
+// AllowMissingFinalTerminator sets whether the last record in the stream may
+// lack its record terminator, as some producers omit it. Such a record is
+// accepted only if it is exactly one byte shorter than its declared length;
+// records before the last always require the terminator.
+func (r *Reader) AllowMissingFinalTerminator(allow bool) {
+	r.policy.AllowMissingFinalTerminator = allow
+}
+
+// CollapseWhitespace sets whether the records read have runs of spaces in
+// their decoded values squeezed to one space and leading and trailing spaces
+// removed (see CollapsingTranscoder). Raw field data is not affected.
+func (r *Reader) CollapseWhitespace(collapse bool) {
+	r.policy.CollapseWhitespace = collapse
+}
+
+// PadShortLeaders sets whether records whose leader is short because the
+// producer dropped trailing positions are repaired before they are parsed
+// (see padLeader).
+func (r *Reader) PadShortLeaders(pad bool) {
+	r.policy.PadShortLeaders = pad
+}
+
+// An UnknownEncodingPolicy says how a record whose leader position 09 is
+// neither ' ' (MARC-8) nor 'a' (UTF-8) is decoded. Such records are only
+// seen when leader validation is off.
+type UnknownEncodingPolicy int
+
+const (
+	// UnknownEncodingUTF8 decodes the record as UTF-8. This is the default.
+	UnknownEncodingUTF8 UnknownEncodingPolicy = iota
+	// UnknownEncodingMARC8 decodes the record as MARC-8.
+	UnknownEncodingMARC8
+	// UnknownEncodingError rejects the record.
+	UnknownEncodingError
+	// UnknownEncodingDetect decodes the record as UTF-8 if its data is valid
+	// UTF-8 free of MARC-8 escape sequences, and as MARC-8 otherwise.
+	UnknownEncodingDetect
+)
+
+// UnknownEncoding sets how records with an unrecognized character encoding
+// are decoded.
+func (r *Reader) UnknownEncoding(policy UnknownEncodingPolicy) {
+	r.policy.UnknownEncoding = policy
+}
+
+// RequireConsistentEncoding sets whether records whose coding scheme, leader
+// position 09, disagrees with their data (see MarcRecord.EncodingConsistent)
+// are rejected with a
+// *LeaderError.
+func (r *Reader) RequireConsistentEncoding(require bool) {
+	r.policy.RequireConsistentEncoding = require
+}
+
+// parse creates a record from raw data read from the stream, applying the
+// reader's options.
+func (r *Reader) parse(raw []byte, offset uint64) (*MarcRecord, error) {
+	p := &r.policy
+	if p.PadShortLeaders {
+		raw = padLeader(raw)
+	}
+	if p.OverrunTolerance > 0 {
+		raw = clampOverruns(raw, p.OverrunTolerance)
+	}
+	if p.RepairFieldTerminators {
+		raw = repairTerminators(raw)
+	}
+	validate := p.ValidateLeader
+	if validate && len(p.LeaderRules) > 0 && len(raw) >= leaderSize+2 {
+		if err := checkLeaderRules(raw, p.LeaderRules); err != nil {
+			return nil, err
+		}
+		validate = false
+	}
+	m, err := newMarcRecord(raw, validate, offset, p.UnknownEncoding)
+	if err != nil {
+		return nil, err
+	}
+	if p.ValidateDirectory {
+		if err := checkDirectory(raw); err != nil {
+			return nil, err
+		}
+	}
+	if p.RequireConsistentEncoding && !m.EncodingConsistent() {
+		return nil, &LeaderError{[]int{9}}
+	}
+	if p.RequiredSubfields != nil {
+		if errs := m.ValidateFields(p.RequiredSubfields); len(errs) > 0 {
+			return nil, errors.Join(errs...)
+		}
+	}
+	if p.CollapseWhitespace {
+		m.transcoder = CollapsingTranscoder(m.transcoder)
+	}
+	m.delims = delimiters{p.SubfieldDelimiter, p.FieldTerminator}
+	return m, nil
+}
+
+// ParseAll parses every record in data, which holds a whole file of records
+// such as one loaded with os.ReadFile. Whitespace between records is skipped
+// as by Reader. The records are not copied: each one's RawRecord aliases data.
+func ParseAll(data []byte, validate bool) ([]*MarcRecord, error) {
+	records := make([]*MarcRecord, 0)
+	offset := 0
+	for {
+		for offset < len(data) && isRecordSpace(data[offset]) {
+			offset++
+		}
+		if offset == len(data) {
+			return records, nil
+		}
+
+		if len(data)-offset < 5 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		rlen, err := DecodeDecimal(data[offset : offset+5])
+		if err != nil || rlen < leaderSize+2 || rlen > maxRecordSize {
+			return nil, errInvalidLength
+		}
+		if len(data)-offset < rlen {
+			return nil, io.ErrUnexpectedEOF
+		}
+		raw := data[offset : offset+rlen : offset+rlen]
+		if raw[rlen-1] != recordTerminator {
+			return nil, errNoRecordTerminator
+		}
+
+		m, err := NewMarcRecord(raw, validate, uint64(offset))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, m)
+		offset += rlen
+	}
 }
 
 //
@@ -129,11 +443,20 @@ func (r *Reader) Next() (*MarcRecord, error) {
 //
 
 func NewMarcRecord(rawData []byte, validate bool, offset uint64) (*MarcRecord, error) {
+	return newMarcRecord(rawData, validate, offset, UnknownEncodingUTF8)
+}
+
+func newMarcRecord(rawData []byte, validate bool, offset uint64, policy UnknownEncodingPolicy) (*MarcRecord, error) {
 	// this assumes that rawData is a superficially valid Z39.2
 	// record: the length is encoded in the first five bytes and
 	// the final byte is a recordTerminator.
-	if validate && !validLeader(rawData) {
-		return nil, errInvalidLeader
+	if len(rawData) < leaderSize+2 {
+		return nil, errInvalidLength
+	}
+	if validate {
+		if err := checkLeader(rawData); err != nil {
+			return nil, err
+		}
 	}
 
 	m := new(MarcRecord)
@@ -143,28 +466,72 @@ func NewMarcRecord(rawData []byte, validate bool, offset uint64) (*MarcRecord, e
 	m.Status = rawData[5]
 	m.Type = rawData[6]
 	m.BibLevel = rawData[7]
-	m.CharacterEncoding = rawData[8]
+	m.CharacterEncoding = rawData[9]
 	m.EncodingLevel = rawData[17]
 	m.CatalogingForm = rawData[18]
 	m.MultipartLevel = rawData[19]
 
-	switch m.CharacterEncoding {
-	case ' ':
-		m.transcoder = marc8Transcoder
-	case 'a':
-		m.transcoder = utf8Transcoder
-	default:
-		// I'm not sure what the best thing to do is here: if leader validation
-		// is turned off we will get here, which is problematic
-		m.transcoder = utf8Transcoder
-		//return nil, fmt.Errorf("Unknown Character Encoding \"%s\"", string(m.CharacterEncoding))
+	encoding := Encoding(m.CharacterEncoding)
+	if encoding != MARC8 && encoding != UTF8 {
+		switch policy {
+		case UnknownEncodingError:
+			return nil, fmt.Errorf("marc21: unknown character encoding %q", m.CharacterEncoding)
+		case UnknownEncodingMARC8:
+			encoding = MARC8
+		case UnknownEncodingDetect:
+			encoding = detectEncoding(rawData[leaderSize:])
+		default:
+			encoding = UTF8
+		}
+	}
+	m.transcoder = utf8Transcoder
+
+	dir, err := decodeDirectory(rawData)
+	if err != nil {
+		return nil, err
 	}
+	m.Directory = dir
 
-	m.Directory = decodeDirectory(rawData)
+	if encoding == MARC8 {
+		m.transcoder = m.alternateGraphicTranscoder()
+	}
+	m.decoder = m.transcoder
 
 	return m, nil
 }
 
+// detectEncoding guesses the encoding of the data part of a record.
+func detectEncoding(data []byte) Encoding {
+	if bytes.IndexByte(data, escape) == -1 && utf8.Valid(data) {
+		return UTF8
+	}
+	return MARC8
+}
+
+// A DirectoryEntry is a single entry in the record directory. StartPos is
+// the starting character position as encoded in the directory, relative to
+// the base address of data; Offset is the absolute position of the field in
+// RawRecord. ImplementationDefined holds the implementation-defined part of
+// the entry, whose length is given by leader position 22; it is empty in
+// MARC 21, and kept when the record is reserialized.
+type DirectoryEntry struct {
+	Tag                   string
+	Length                int
+	StartPos              int
+	Offset                int
+	ImplementationDefined []byte
+}
+
+// DirectoryEntries returns the record directory in its original order.
+func (m *MarcRecord) DirectoryEntries() []DirectoryEntry {
+	entries, _ := decodeEntries(m.RawRecord)
+	result := make([]DirectoryEntry, len(entries))
+	for i, e := range entries {
+		result[i] = DirectoryEntry{e.tag, e.length, e.startPos, e.offset, e.impl}
+	}
+	return result
+}
+
 // GetFieldList returns a sorted list of the field tags in the record.
 func (m *MarcRecord) GetFieldList() []string {
 	keys := make([]string, len(m.Directory))
@@ -177,11 +544,36 @@ func (m *MarcRecord) GetFieldList() []string {
 	return keys
 }
 
+// FieldTags returns the tag of every field in directory order, including
+// repeats, so its length is the number of fields in the record.
+func (m *MarcRecord) FieldTags() []string {
+	entries, _ := decodeEntries(m.RawRecord)
+	tags := make([]string, len(entries))
+	for i, e := range entries {
+		tags[i] = e.tag
+	}
+	return tags
+}
+
 // GetLeader returns the leader of the record
 func (m *MarcRecord) GetLeader() string {
 	return string(m.RawRecord[:leaderSize])
 }
 
+// LeaderByte returns the byte at position pos of the leader.
+func (m *MarcRecord) LeaderByte(pos int) (byte, error) {
+	if pos < 0 || pos >= leaderSize {
+		return 0, fmt.Errorf("marc21: leader position %d is out of range", pos)
+	}
+	if len(m.RawRecord) < leaderSize {
+		return 0, errInvalidLength
+	}
+	return m.RawRecord[pos], nil
+}
+
+// GetRawField returns every instance of the tag field. Each instance's raw
+// bytes include the trailing field terminator; use GetRawFieldData for the
+// bytes without it.
 func (m *MarcRecord) GetRawField(tag string) VariableField {
 	entry := m.Directory[tag]
 	if entry == nil {
@@ -195,7 +587,22 @@ func (m *MarcRecord) GetRawField(tag string) VariableField {
 		result[i] = m.RawRecord[start:end]
 	}
 
-	return VariableField{tag, result, m.transcoder}
+	return VariableField{tag, result, m.transcoder, m.delims}
+}
+
+// GetRawFieldData returns the raw bytes of every instance of the tag field
+// with the field terminator removed, as GetControlField does. The slices
+// alias RawRecord.
+func (m *MarcRecord) GetRawFieldData(tag string) [][]byte {
+	field := m.GetRawField(tag)
+	result := make([][]byte, len(field.rawData))
+	for i, data := range field.rawData {
+		if n := len(data); n > 0 && data[n-1] == fieldTerminator {
+			data = data[:n-1]
+		}
+		result[i] = data
+	}
+	return result
 }
 
 func (m *MarcRecord) GetControlField(tag string) (string, error) {
@@ -212,9 +619,34 @@ func (m *MarcRecord) GetControlField(tag string) (string, error) {
 		return "", fmt.Errorf("marc21: too many instances of control field \"%s\"", tag)
 	}
 
+	// a corrupt directory entry may give the field no data at all, not even
+	// its terminator
 	cf := field.rawData[0]
+	if n := len(cf); n > 0 && cf[n-1] == fieldTerminator {
+		cf = cf[:n-1]
+	}
+	return string(cf), nil
+}
+
+// FirstControlField returns the value of the first instance of the tag
+// control field, ignoring any repeats, or the empty string if the field is
+// missing or tag is not a control field.
+func (m *MarcRecord) FirstControlField(tag string) string {
+	if !IsControlFieldTag(tag) {
+		return ""
+	}
+	data := m.GetRawFieldData(tag)
+	if len(data) == 0 {
+		return ""
+	}
+	return string(data[0])
+}
 
-	return string(cf[:len(cf)-1]), nil
+// ControlNumber returns the value of the 001 field, or the empty string if
+// the record has none.
+func (m *MarcRecord) ControlNumber() string {
+	cn, _ := m.GetControlField("001")
+	return cn
 }
 
 func (m *MarcRecord) GetDataField(tag string) (VariableField, error) {
@@ -225,6 +657,259 @@ func (m *MarcRecord) GetDataField(tag string) (VariableField, error) {
 	return field, nil
 }
 
+// GetSubfield returns the first code subfield in any instance of the tag
+// field, or the empty string if there is none.
+func (m *MarcRecord) GetSubfield(tag, code string) string {
+	return m.FirstSubfieldOf(code, tag)
+}
+
+// FirstSubfieldOf tries each of tags in order and returns the first code
+// subfield found in any of its instances, or the empty string if none of the
+// fields has one.
+func (m *MarcRecord) FirstSubfieldOf(code string, tags ...string) string {
+	for _, tag := range tags {
+		field := m.GetRawField(tag)
+		for i := 0; i < field.ValueCount(); i++ {
+			if field.GetNthRawSubfield(code, i) != nil {
+				return field.GetNthSubfield(code, i)
+			}
+		}
+	}
+	return ""
+}
+
+// GetDataFieldValues joins the values of the subfields with any of codes,
+// such as "ax", in every instance of the tag field: the subfields of an
+// instance in field order separated by subfieldSep, and the instances
+// separated by instanceSep. Instances with none of the subfields are
+// skipped.
+func (m *MarcRecord) GetDataFieldValues(tag string, codes string, instanceSep, subfieldSep string) string {
+	field := m.GetRawField(tag)
+	instances := make([]string, 0, field.ValueCount())
+	for i := 0; i < field.ValueCount(); i++ {
+		values := make([]string, 0)
+		sr := field.SubfieldReader(i)
+		for code, raw, ok := sr.Next(); ok; code, raw, ok = sr.Next() {
+			if strings.IndexByte(codes, code) != -1 {
+				v, _ := field.transcoder(raw)
+				values = append(values, v)
+			}
+		}
+		if len(values) > 0 {
+			instances = append(instances, strings.Join(values, subfieldSep))
+		}
+	}
+	return strings.Join(instances, instanceSep)
+}
+
+// SubfieldInventory maps the tag of each data field in the record to the
+// sorted set of subfield codes used across all of its instances.
+func (m *MarcRecord) SubfieldInventory() map[string][]string {
+	inventory := make(map[string][]string)
+	for _, tag := range m.GetFieldList() {
+		if IsControlFieldTag(tag) {
+			continue
+		}
+		field := m.GetRawField(tag)
+		seen := make(map[string]bool)
+		codes := make([]string, 0)
+		for i := 0; i < field.ValueCount(); i++ {
+			for _, code := range field.GetSubfields(i) {
+				if !seen[code] {
+					seen[code] = true
+					codes = append(codes, code)
+				}
+			}
+		}
+		sort.Strings(codes)
+		inventory[tag] = codes
+	}
+	return inventory
+}
+
+// A SubfieldRow is a single value in the table returned by Flatten.
+// Instance numbers the occurrences of Tag from 0. For a control field Code,
+// Ind1 and Ind2 are empty.
+type SubfieldRow struct {
+	Tag      string
+	Instance int
+	Code     string
+	Value    string
+	Ind1     string
+	Ind2     string
+}
+
+// Flatten returns every control field value and subfield in the record as a
+// table, in directory order.
+func (m *MarcRecord) Flatten() []SubfieldRow {
+	rows := make([]SubfieldRow, 0)
+	instances := make(map[string]int)
+	_, ft := m.delims.get()
+	entries, _ := decodeEntries(m.RawRecord)
+	for _, e := range entries {
+		data := m.RawRecord[e.offset : e.offset+e.length]
+		instance := instances[e.tag]
+		instances[e.tag]++
+
+		if IsControlFieldTag(e.tag) {
+			if len(data) > 0 && data[len(data)-1] == ft {
+				data = data[:len(data)-1]
+			}
+			value, _ := m.transcoder(data)
+			rows = append(rows, SubfieldRow{Tag: e.tag, Instance: instance, Value: value})
+			continue
+		}
+		if len(data) < 2 {
+			continue
+		}
+		for _, sf := range subfieldChunks(data[2:], m.delims) {
+			value, _ := m.transcoder(sf[1:])
+			rows = append(rows, SubfieldRow{e.tag, instance, string(sf[0]), value, string(data[0]), string(data[1])})
+		}
+	}
+	return rows
+}
+
+// GetFieldsInRange returns each instance of the fields whose tags fall
+// lexically within [low, high], in tag order. Every returned field holds
+// exactly one instance.
+func (m *MarcRecord) GetFieldsInRange(low, high string) []*VariableField {
+	result := make([]*VariableField, 0)
+	for _, tag := range m.GetFieldList() {
+		if tag < low || tag > high {
+			continue
+		}
+		result = append(result, m.GetFieldInstances(tag)...)
+	}
+	return result
+}
+
+// GetFieldInstances returns each instance of the tag field as a separate
+// VariableField, so the instance index passed to its accessors is always 0.
+func (m *MarcRecord) GetFieldInstances(tag string) []*VariableField {
+	field := m.GetRawField(tag)
+	result := make([]*VariableField, len(field.rawData))
+	for i := range field.rawData {
+		result[i] = &VariableField{tag, field.rawData[i : i+1], m.transcoder, m.delims}
+	}
+	return result
+}
+
+// GetFieldsMatching returns the instances of the tag field for which pred,
+// given the field and an instance index, returns true. Like
+// GetFieldInstances, each instance is returned as a separate VariableField.
+func (m *MarcRecord) GetFieldsMatching(tag string, pred func(*VariableField, int) bool) []*VariableField {
+	field := m.GetRawField(tag)
+	result := make([]*VariableField, 0)
+	for i := range field.rawData {
+		if pred(&field, i) {
+			result = append(result, &VariableField{tag, field.rawData[i : i+1], m.transcoder, m.delims})
+		}
+	}
+	return result
+}
+
+// VernacularField returns the 880 alternate graphic representation linked by
+// its $6 to the given tag and occurrence number, e.g. the vernacular form of
+// a 245 whose $6 is "880-01" has a $6 of "245-01". It returns nil if there
+// is none.
+func (m *MarcRecord) VernacularField(tag string, occurrence int) *VariableField {
+	linked := m.GetFieldsMatching("880", func(f *VariableField, i int) bool {
+		t, occ := f.LinkTag(i)
+		return t == tag && occ == occurrence
+	})
+	if len(linked) == 0 {
+		return nil
+	}
+	return linked[0]
+}
+
+// ParseSafe parses a single record from untrusted input. The record length in
+// the first five bytes must match len(data). The leader is not validated. Any
+// panic while parsing is recovered and returned as an error.
+func ParseSafe(data []byte) (m *MarcRecord, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			m, err = nil, fmt.Errorf("marc21: unable to parse record: %v", r)
+		}
+	}()
+
+	if len(data) < leaderSize+2 {
+		return nil, errInvalidLength
+	}
+	if rlen, e := DecodeDecimal(data[:5]); e != nil || rlen != len(data) {
+		return nil, errInvalidLength
+	}
+	if data[len(data)-1] != recordTerminator {
+		return nil, errNoRecordTerminator
+	}
+
+	return NewMarcRecord(data, false, 0)
+}
+
+// The MARC 21 field blocks, as keys of FieldsByBlock.
+const (
+	BlockControl             = "control"
+	BlockNumbers             = "numbers and codes"
+	BlockMainEntry           = "main entry"
+	BlockTitles              = "titles"
+	BlockEditionImprint      = "edition and imprint"
+	BlockPhysicalDescription = "physical description"
+	BlockSeries              = "series"
+	BlockNotes               = "notes"
+	BlockSubjects            = "subjects"
+	BlockAddedEntries        = "added entries"
+	BlockSeriesAddedEntries  = "series added entries"
+	BlockLocal               = "holdings and local"
+)
+
+// fieldBlock returns the block of the tag, or the empty string if the tag is
+// not numeric.
+func fieldBlock(tag string) string {
+	if len(tag) != 3 || tag < "000" || tag > "999" {
+		return ""
+	}
+	switch tag[0] {
+	case '0':
+		if tag[1] == '0' {
+			return BlockControl
+		}
+		return BlockNumbers
+	case '1':
+		return BlockMainEntry
+	case '2':
+		if tag < "250" {
+			return BlockTitles
+		}
+		return BlockEditionImprint
+	case '3':
+		return BlockPhysicalDescription
+	case '4':
+		return BlockSeries
+	case '5':
+		return BlockNotes
+	case '6':
+		return BlockSubjects
+	case '7':
+		return BlockAddedEntries
+	case '8':
+		return BlockSeriesAddedEntries
+	}
+	return BlockLocal
+}
+
+// FieldsByBlock groups each field instance in the record, in directory order,
+// by its MARC 21 block. Fields with non-numeric tags are omitted.
+func (m *MarcRecord) FieldsByBlock() map[string][]*VariableField {
+	blocks := make(map[string][]*VariableField)
+	for _, f := range m.rawFields() {
+		if block := fieldBlock(f.tag); block != "" {
+			blocks[block] = append(blocks[block], &VariableField{f.tag, [][]byte{f.data}, m.transcoder, m.delims})
+		}
+	}
+	return blocks
+}
+
 //
 // Variable Field functions
 //
@@ -233,23 +918,48 @@ func (f *VariableField) ValueCount() int {
 	return len(f.rawData)
 }
 
+// GetRawValue returns the raw data of the field instance, or nil if there is
+// no instance i.
 func (f *VariableField) GetRawValue(i int) []byte {
+	if i < 0 || i >= len(f.rawData) {
+		return nil
+	}
 	return f.rawData[i]
 }
 
+// SetTranscoder overrides the transcoder used to decode the field's values,
+// which defaults to the one chosen by the record's character encoding.
+func (f *VariableField) SetTranscoder(t Transcoder) {
+	f.transcoder = t
+}
+
+// RawLength returns the length of the instance's raw data, including the
+// indicators and field terminator, as recorded in the directory.
+func (f *VariableField) RawLength(index int) int {
+	return len(f.GetRawValue(index))
+}
+
 func (f *VariableField) IsControlField() bool {
 	return IsControlFieldTag(f.Tag)
 }
 
+// implicitSubfield is the code given to data that follows the indicators
+// without a leading delimiter.
+const implicitSubfield = 'a'
+
 // GetSubfields returns a sorted list of subfield tags for the field
 // instance specified by index.
 func (f *VariableField) GetSubfields(index int) []string {
 	instance := f.GetRawValue(index)
+	sd, ft := f.delims.get()
 
 	subfields := make([]string, 0, 10)
 
+	if !f.IsControlField() && len(instance) > 2 && instance[2] != sd && instance[2] != ft {
+		subfields = append(subfields, string(implicitSubfield))
+	}
 	for i := range instance {
-		if instance[i] == delimiter {
+		if instance[i] == sd && i+1 < len(instance) {
 			subfields = append(subfields, string(instance[i+1]))
 		}
 	}
@@ -259,26 +969,47 @@ func (f *VariableField) GetSubfields(index int) []string {
 
 func (f *VariableField) GetNthRawSubfield(subfield string, index int) []byte {
 	rv := f.GetRawValue(index)
+	sd, ft := f.delims.get()
 	i := 2
 	sf := subfield[0]
 
-	// in a properly formed record rv[i] will be a delimiter, but check anyway
-	if rv[i] == delimiter {
+	// every scan is bounded by len(rv) as well as the field terminator, since
+	// an instance from a corrupt record may be missing its terminator
+	if i >= len(rv) {
+		return nil
+	}
+
+	// in a properly formed record rv[i] will be a delimiter, but some vendors
+	// omit it: treat the data up to the first delimiter as an implicit $a.
+	// Control fields have no subfields, so no implicit one either.
+	if rv[i] != sd && rv[i] != ft {
+		if f.IsControlField() {
+			return nil
+		}
+		start := i
+		for i < len(rv) && rv[i] != sd && rv[i] != ft {
+			i++
+		}
+		if sf == implicitSubfield {
+			return rv[start:i]
+		}
+	}
+	if i < len(rv) && rv[i] == sd {
 	delim:
 		i++
-		if rv[i] == sf {
+		if i < len(rv) && rv[i] == sf {
 			i++
 			start := i
-			for rv[i] != delimiter && rv[i] != fieldTerminator {
+			for i < len(rv) && rv[i] != sd && rv[i] != ft {
 				i++
 			}
 			return rv[start:i]
 		}
-		for {
+		for i < len(rv) {
 			switch rv[i] {
-			case delimiter:
+			case sd:
 				goto delim
-			case fieldTerminator:
+			case ft:
 				return nil
 			default:
 				i++
@@ -297,27 +1028,234 @@ func (f *VariableField) GetNthSubfield(subfield string, index int) string {
 	return ""
 }
 
+// subfieldValues returns the decoded value of every code subfield in the
+// field instance, in order.
+func (f *VariableField) subfieldValues(code string, index int) []string {
+	values := make([]string, 0)
+	sr := f.SubfieldReader(index)
+	for c, raw, ok := sr.Next(); ok; c, raw, ok = sr.Next() {
+		if string(c) == code {
+			v, _ := f.transcoder(raw)
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// SubfieldCount returns the number of code subfields in the field instance.
+func (f *VariableField) SubfieldCount(code string, index int) int {
+	n := 0
+	sr := f.SubfieldReader(index)
+	for c, _, ok := sr.Next(); ok; c, _, ok = sr.Next() {
+		if string(c) == code {
+			n++
+		}
+	}
+	return n
+}
+
+// A SubfieldReader walks the subfields of a single field instance in one
+// pass. The values returned alias the record's raw data.
+type SubfieldReader struct {
+	data   []byte
+	pos    int
+	delims delimiters
+}
+
+// SubfieldReader returns a SubfieldReader over the subfields of the field
+// instance. Data before the first delimiter is read as an implicit $a, as by
+// GetNthRawSubfield.
+func (f *VariableField) SubfieldReader(index int) *SubfieldReader {
+	data := f.GetRawValue(index)
+	if f.IsControlField() || len(data) < 2 {
+		return &SubfieldReader{}
+	}
+	return &SubfieldReader{data, 2, f.delims}
+}
+
+// Next returns the code and raw value of the next subfield, with ok false
+// once the instance is exhausted.
+func (sr *SubfieldReader) Next() (code byte, value []byte, ok bool) {
+	d := sr.data
+	sd, ft := sr.delims.get()
+	if sr.pos >= len(d) || d[sr.pos] == ft {
+		return 0, nil, false
+	}
+	code = implicitSubfield
+	if d[sr.pos] == sd {
+		if sr.pos+1 >= len(d) || d[sr.pos+1] == ft {
+			sr.pos = len(d)
+			return 0, nil, false
+		}
+		code = d[sr.pos+1]
+		sr.pos += 2
+	}
+	start := sr.pos
+	for sr.pos < len(d) && d[sr.pos] != sd && d[sr.pos] != ft {
+		sr.pos++
+	}
+	return code, d[start:sr.pos], true
+}
+
+// JoinSubfield returns the values of every code subfield in the field
+// instance joined by sep, e.g. the $a of a 650 joined by "--" for a subject
+// heading display. It returns "" if there are none.
+func (f *VariableField) JoinSubfield(code string, index int, sep string) string {
+	return strings.Join(f.subfieldValues(code, index), sep)
+}
+
+// GetSubfieldsByCodes returns the first value of each of codes in the field
+// instance, in the order the codes are given. A missing subfield yields an
+// empty string, so the result always has one entry per code.
+func (f *VariableField) GetSubfieldsByCodes(index int, codes ...string) []string {
+	values := make([]string, len(codes))
+	for i, code := range codes {
+		values[i] = f.GetNthSubfield(code, index)
+	}
+	return values
+}
+
+// GetNthSubfieldTrimmed is GetNthSubfield with trailing ISBD punctuation
+// removed by TrimISBD.
+func (f *VariableField) GetNthSubfieldTrimmed(subfield string, index int) string {
+	return TrimISBD(f.GetNthSubfield(subfield, index))
+}
+
+// LinkTag parses the $6 linkage subfield of the field instance, of the form
+// "NNN-OO[/...]", returning the linked tag and occurrence number. It returns
+// "" and 0 if the subfield is missing or malformed.
+func (f *VariableField) LinkTag(index int) (string, int) {
+	link := f.GetNthRawSubfield("6", index)
+	if len(link) < 6 || link[3] != '-' {
+		return "", 0
+	}
+	occ, err := DecodeDecimal(link[4:6])
+	if err != nil {
+		return "", 0
+	}
+	if _, err = DecodeDecimal(link[0:3]); err != nil {
+		return "", 0
+	}
+	return string(link[0:3]), occ
+}
+
+// IsRightToLeft reports whether the $6 linkage subfield of the field
+// instance, of the form "NNN-OO/SSS/r", marks its script as right-to-left,
+// as for Hebrew and Arabic. The orientation code follows the script
+// identification code; without it the field is left-to-right.
+func (f *VariableField) IsRightToLeft(index int) bool {
+	parts := bytes.Split(bytes.TrimSpace(f.GetNthRawSubfield("6", index)), []byte("/"))
+	return len(parts) >= 3 && string(parts[len(parts)-1]) == "r"
+}
+
+// IndicatorBlank is a blank indicator as stored in a record, and as written
+// to JSON.
+const IndicatorBlank byte = ' '
+
+// IndicatorBlankDisplay is a blank indicator as shown by FormatIndicator,
+// following the MARC 21 documentation. The .mrk format written by MrkWriter
+// uses a backslash instead.
+const IndicatorBlankDisplay = "#"
+
+// FormatIndicator returns an indicator for display, with a blank shown as
+// IndicatorBlankDisplay.
+func FormatIndicator(ind byte) string {
+	return formatIndicator(ind, IndicatorBlankDisplay)
+}
+
+func formatIndicator(ind byte, blank string) string {
+	if ind == IndicatorBlank {
+		return blank
+	}
+	return string(ind)
+}
+
+// GetIndicators returns the two indicators of the field instance, formatted
+// by FormatIndicator. Control fields have no indicators, so for them, and for
+// data too short to hold indicators, it returns the empty string.
 func (f *VariableField) GetIndicators(index int) string {
-	ind := ""
-	if f.rawData[index][0] == ' ' {
-		ind += "#"
-	} else {
-		ind += string(f.rawData[index][0])
+	data := f.GetRawValue(index)
+	if f.IsControlField() || len(data) < 3 {
+		return ""
 	}
-	if f.rawData[index][1] == ' ' {
-		ind += "#"
-	} else {
-		ind += string(f.rawData[index][1])
+	return FormatIndicator(data[0]) + FormatIndicator(data[1])
+}
+
+// subfieldChunks splits a data field instance into its subfields. Each chunk
+// starts with the subfield code; the indicators and terminator are dropped.
+// Data before the first delimiter is returned as an implicit $a chunk, as
+// GetNthSubfield reads it, so that it survives when the chunks are
+// reencoded. The instance is split on the delimiters d.
+func subfieldChunks(instance []byte, d delimiters) [][]byte {
+	sd, ft := d.get()
+	chunks := make([][]byte, 0, 10)
+	start := -1
+	for i := range instance {
+		if instance[i] == sd || instance[i] == ft {
+			if start == -1 && i > 0 {
+				chunks = append(chunks, append([]byte{implicitSubfield}, instance[:i]...))
+			} else if start != -1 && i > start {
+				chunks = append(chunks, instance[start:i])
+			}
+			start = i + 1
+		}
 	}
-	return ind
+	return chunks
 }
 
-func utf8Transcoder(bytes []byte) (string, error) {
-	return string(bytes), nil
+// isbdPunctuation is the trailing punctuation removed by TrimISBD.
+const isbdPunctuation = "/:;,"
+
+// TrimISBD removes trailing ISBD punctuation and surrounding whitespace from
+// a subfield value, e.g. "Garden exhibition /" becomes "Garden exhibition".
+func TrimISBD(s string) string {
+	s = strings.TrimSpace(s)
+	for len(s) > 0 && strings.IndexByte(isbdPunctuation, s[len(s)-1]) != -1 {
+		s = strings.TrimSpace(s[:len(s)-1])
+	}
+	return s
+}
+
+// CollapsingTranscoder returns a Transcoder that decodes with t, then
+// squeezes each run of spaces to a single space and trims spaces from both
+// ends.
+func CollapsingTranscoder(t Transcoder) Transcoder {
+	return func(bytes []byte) (string, error) {
+		s, err := t(bytes)
+		words := strings.Split(s, " ")
+		kept := words[:0]
+		for _, w := range words {
+			if w != "" {
+				kept = append(kept, w)
+			}
+		}
+		return strings.Join(kept, " "), err
+	}
+}
+
+// VisibleString renders raw field data for display, escaping delimiters,
+// terminators, and any other unprintable bytes as \xNN (and backslashes as
+// \\). Printable UTF-8 is left as is.
+func VisibleString(raw []byte) string {
+	var b strings.Builder
+	for len(raw) > 0 {
+		r, size := utf8.DecodeRune(raw)
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == utf8.RuneError && size == 1, !unicode.IsPrint(r):
+			for _, c := range raw[:size] {
+				fmt.Fprintf(&b, "\\x%02x", c)
+			}
+		default:
+			b.Write(raw[:size])
+		}
+		raw = raw[size:]
+	}
+	return b.String()
 }
 
-func marc8Transcoder(bytes []byte) (string, error) {
-	// FIXME: write the marc8Transcoder
+func utf8Transcoder(bytes []byte) (string, error) {
 	return string(bytes), nil
 }
 
@@ -325,46 +1263,387 @@ func marc8Transcoder(bytes []byte) (string, error) {
 // Internal functions
 //
 
-func validLeader(leader []byte) bool {
-	for i := range marc21LeaderValues {
-		s := string(leader[marc21LeaderValues[i].offset])
-		if strings.IndexAny(marc21LeaderValues[i].values, s) == -1 {
+// A LeaderError is returned when leader validation fails. Positions lists
+// every leader position holding a value the MARC 21 rules do not allow.
+type LeaderError struct {
+	Positions []int
+}
+
+func (e *LeaderError) Error() string {
+	pos := make([]string, len(e.Positions))
+	for i := range e.Positions {
+		pos[i] = strconv.Itoa(e.Positions[i])
+	}
+	return "marc21: leader is invalid at positions " + strings.Join(pos, ", ")
+}
+
+// checkLeader returns a *LeaderError describing the invalid positions in the
+// leader, or nil if it is valid.
+func checkLeader(leader []byte) error {
+	return checkLeaderRules(leader, nil)
+}
+
+// checkLeaderRules is checkLeader with the MARC 21 rules amended by rules
+// (see Policy.LeaderRules).
+func checkLeaderRules(leader []byte, rules map[int]string) error {
+	allowed := make(map[int]string, len(marc21LeaderValues)+len(rules))
+	for _, v := range marc21LeaderValues {
+		allowed[v.offset] = v.values
+	}
+	for pos, values := range rules {
+		if pos >= 0 && pos < leaderSize {
+			allowed[pos] = values
+		}
+	}
+	positions := make([]int, 0, len(allowed))
+	for pos, values := range allowed {
+		if values != "" {
+			positions = append(positions, pos)
+		}
+	}
+	sort.Ints(positions)
+
+	var bad []int
+	for _, pos := range positions {
+		s := string(leader[pos])
+		if strings.IndexAny(allowed[pos], s) == -1 {
 			log.Printf("Leader position %d invalid, got %s expect one of '%s'\n",
-				marc21LeaderValues[i].offset, s, marc21LeaderValues[i].values)
-			return false
+				pos, s, allowed[pos])
+			bad = append(bad, pos)
+		}
+	}
+	if bad != nil {
+		return &LeaderError{bad}
+	}
+	return nil
+}
+
+// ValidateFields checks the record's data fields against rules, which maps a
+// tag to the subfield codes every instance of that tag must contain, e.g.
+// {"245": {"a"}}. It returns an error for each missing subfield, ordered by
+// tag and instance; tags absent from the record are not checked.
+func (m *MarcRecord) ValidateFields(rules map[string][]string) []error {
+	tags := make([]string, 0, len(rules))
+	for tag := range rules {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	errs := make([]error, 0)
+	for _, tag := range tags {
+		if len(tag) != 3 || IsControlFieldTag(tag) {
+			continue
+		}
+		field := m.GetRawField(tag)
+		for i := 0; i < field.ValueCount(); i++ {
+			for _, code := range rules[tag] {
+				if code != "" && field.GetNthRawSubfield(code, i) == nil {
+					errs = append(errs, fmt.Errorf("marc21: %s instance %d is missing required subfield $%s", tag, i, code))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+func validLeader(leader []byte) bool {
+	return checkLeader(leader) == nil
+}
+
+// NormalizeTag left-pads a numeric tag shorter than three characters with
+// zeros, so that a tag stored as an integer, such as "1", becomes "001".
+// Other tags are returned unchanged. The methods of MarcRecord and
+// RecordBuilder that add or change fields normalize the tags passed to them.
+func NormalizeTag(tag string) string {
+	if tag == "" || len(tag) >= 3 {
+		return tag
+	}
+	for i := 0; i < len(tag); i++ {
+		if tag[i] < '0' || tag[i] > '9' {
+			return tag
 		}
 	}
-	return true
+	return strings.Repeat("0", 3-len(tag)) + tag
 }
 
+// IsControlFieldTag reports whether tag is that of a control field (00X).
+// Malformed tags shorter than two characters are not.
 func IsControlFieldTag(tag string) bool {
-	return tag[0] == '0' && tag[1] == '0'
+	return len(tag) >= 2 && tag[0] == '0' && tag[1] == '0'
 }
 
-func decodeDirectory(record []byte) map[string][]location {
-	baseAddress := decodeDecimal(record[12:17])
+// maxLeaderPadding is the number of trailing leader positions padLeader
+// will restore: 17 through 23, leaving the base address intact.
+const maxLeaderPadding = 7
+
+// padLeader returns record with a short leader padded to leaderSize. A
+// leader is taken to be short by k bytes when the directory, which ends at
+// the base address, would only be a whole number of entries if it started k
+// bytes early. The missing positions are filled with spaces, except 20-23,
+// which are constant in MARC 21 and get their "4500" values, and the record
+// length and base address are adjusted. A record whose directory can be
+// read under its own entry map, which may declare entries longer than
+// MARC 21's, is not short, and it and any other record are returned as is.
+func padLeader(record []byte) []byte {
+	if len(record) < leaderSize {
+		return record
+	}
+	if _, err := decodeEntries(record); err == nil {
+		return record
+	}
+	base, err := DecodeDecimal(record[12:17])
+	if err != nil || base < 1 || base > len(record) || record[base-1] != fieldTerminator {
+		return record
+	}
+	k := ((leaderSize-(base-1))%entrySize + entrySize) % entrySize
+	if k == 0 || k > maxLeaderPadding || base-1 < leaderSize-k {
+		return record
+	}
+
+	padded := make([]byte, 0, len(record)+k)
+	padded = append(padded, record[:leaderSize-k]...)
+	for i := leaderSize - k; i < leaderSize; i++ {
+		if i >= 20 {
+			padded = append(padded, "4500"[i-20])
+		} else {
+			padded = append(padded, ' ')
+		}
+	}
+	padded = append(padded, record[leaderSize-k:]...)
+	copy(padded[0:5], encodeDecimal(len(padded), 5))
+	copy(padded[12:17], encodeDecimal(base+k, 5))
+	return padded
+}
+
+// clampOverruns returns record with the length of every directory entry
+// that runs past the record terminator by at most tolerance bytes reduced to
+// end before it. If no entry needs clamping, or the directory cannot be
+// read, record is returned as is; otherwise it is copied.
+func clampOverruns(record []byte, tolerance int) []byte {
+	if len(record) < leaderSize+2 {
+		return record
+	}
+	base, err := DecodeDecimal(record[12:17])
+	if err != nil || base <= leaderSize || base >= len(record) {
+		return record
+	}
+	lenSize, startSize, implSize, err := decodeEntryMap(record)
+	if err != nil {
+		return record
+	}
+	size := 3 + lenSize + startSize + implSize
+	limit := len(record) - 1
+
+	clamped, copied := record, false
+	for i := leaderSize; i+size <= base-1; i += size {
+		lenField := record[i+3 : i+3+lenSize]
+		length, e1 := DecodeDecimal(lenField)
+		start, e2 := DecodeDecimal(record[i+3+lenSize : i+3+lenSize+startSize])
+		if e1 != nil || e2 != nil {
+			return record
+		}
+		over := base + start + length - limit
+		if over <= 0 || over > tolerance || length < over {
+			continue
+		}
+		if !copied {
+			clamped, copied = append([]byte(nil), record...), true
+		}
+		copy(clamped[i+3:i+3+lenSize], encodeDecimal(length-over, lenSize))
+	}
+	return clamped
+}
+
+// repairTerminators returns record with the last byte of every field that
+// is not a field terminator replaced by one. If no field needs repair, or
+// the directory cannot be read, record is returned as is; otherwise it is
+// copied.
+func repairTerminators(record []byte) []byte {
+	entries, err := decodeEntries(record)
+	if err != nil {
+		return record
+	}
+	repaired, copied := record, false
+	for _, e := range entries {
+		end := e.offset + e.length - 1
+		if e.length == 0 || record[end] == fieldTerminator {
+			continue
+		}
+		if !copied {
+			repaired, copied = append([]byte(nil), record...), true
+		}
+		repaired[end] = fieldTerminator
+	}
+	return repaired
+}
+
+// A dirEntry is a single directory entry, kept in the order it appears in
+// the record.
+type dirEntry struct {
+	tag      string
+	startPos int    // relative to the base address, as encoded
+	impl     []byte // the implementation-defined part, if any
+	location
+}
+
+// decodeEntries decodes the directory, bounding every access by the base
+// address and the record length so that truncated or corrupt input produces
+// an error rather than a panic.
+func decodeEntries(record []byte) ([]dirEntry, error) {
+	if len(record) < leaderSize+2 {
+		return nil, errInvalidLength
+	}
+	baseAddress, err := DecodeDecimal(record[12:17])
+	if err != nil || baseAddress <= leaderSize || baseAddress >= len(record) {
+		return nil, errInvalidBaseAddress
+	}
+	if record[baseAddress-1] != fieldTerminator {
+		return nil, errNoDirectoryTerminator
+	}
+	lenSize, startSize, implSize, err := decodeEntryMap(record)
+	if err != nil {
+		return nil, err
+	}
+	size := 3 + lenSize + startSize + implSize
+
+	end := baseAddress - 1
+	entries := make([]dirEntry, 0, (end-leaderSize)/size)
+
+	for i := leaderSize; i < end; i += size {
+		if i+size > end {
+			return nil, errDirectoryTruncated
+		}
+		length, e1 := DecodeDecimal(record[i+3 : i+3+lenSize])
+		start, e2 := DecodeDecimal(record[i+3+lenSize : i+3+lenSize+startSize])
+		if e1 != nil || e2 != nil {
+			return nil, errInvalidDirectory
+		}
+		loc := location{baseAddress + start, length}
+		if loc.offset+loc.length > len(record)-1 {
+			return nil, errInvalidDirectory
+		}
+		var impl []byte
+		if implSize > 0 {
+			impl = record[i+size-implSize : i+size]
+		}
+		entries = append(entries, dirEntry{string(record[i : i+3]), start, impl, loc})
+	}
+
+	return entries, nil
+}
+
+// checkDirectory checks what decodeEntries does not: that every tag is
+// three alphanumeric characters, that every field ends with a field
+// terminator, and that no two fields overlap.
+func checkDirectory(record []byte) error {
+	entries, err := decodeEntries(record)
+	if err != nil {
+		return err
+	}
+	sorted := make([]dirEntry, len(entries))
+	for i, e := range entries {
+		for j := 0; j < 3; j++ {
+			c := e.tag[j]
+			if !('0' <= c && c <= '9' || 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z') {
+				return fmt.Errorf("marc21: directory entry %d has invalid tag %q", i, e.tag)
+			}
+		}
+		if e.length == 0 || record[e.offset+e.length-1] != fieldTerminator {
+			return fmt.Errorf("marc21: field %s at directory entry %d is not terminated", e.tag, i)
+		}
+		sorted[i] = e
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].offset < sorted[j].offset })
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].offset < sorted[i-1].offset+sorted[i-1].length {
+			return fmt.Errorf("marc21: fields %s and %s overlap", sorted[i-1].tag, sorted[i].tag)
+		}
+	}
+	return nil
+}
+
+// decodeEntryMap decodes the entry map in leader positions 20 -- 22: the
+// sizes of the length-of-field, starting-character-position, and
+// implementation-defined parts of each directory entry. In MARC 21 these are
+// always 4, 5, and 0.
+func decodeEntryMap(record []byte) (int, int, int, error) {
+	lenSize, e1 := DecodeDecimal(record[20:21])
+	startSize, e2 := DecodeDecimal(record[21:22])
+	implSize, e3 := DecodeDecimal(record[22:23])
+	if e1 != nil || e2 != nil || e3 != nil || lenSize == 0 || startSize == 0 {
+		return 0, 0, 0, errInvalidDirectory
+	}
+	return lenSize, startSize, implSize, nil
+}
+
+func decodeDirectory(record []byte) (map[string][]location, error) {
+	entries, err := decodeEntries(record)
+	if err != nil {
+		return nil, err
+	}
 
 	m := make(map[string][]location)
 
-	for i := 24; record[i] != fieldTerminator; i += 12 {
-		tag := string(record[i : i+3])
-		m[tag] = append(m[tag],
-			location{baseAddress + decodeDecimal(record[i+7:i+12]), decodeDecimal(record[i+3 : i+7])})
+	for _, e := range entries {
+		m[e.tag] = append(m[e.tag], e.location)
 	}
 
-	return m
+	return m, nil
+}
+
+// utf8BOM is the UTF-8 byte-order mark, which some Windows tools write at the
+// start of a file.
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// skipBOM discards a byte-order mark at the start of the input, counting it
+// in the offset.
+func (r *Reader) skipBOM() {
+	if r.started {
+		return
+	}
+	r.started = true
+	if b, err := r.r.Peek(len(utf8BOM)); err == nil && bytes.Equal(b, utf8BOM) {
+		r.r.Discard(len(utf8BOM))
+		r.offset += uint64(len(utf8BOM))
+	}
 }
 
-func readRecord(r io.Reader) (int, []byte, error) {
+// skipWhitespace discards any line breaks or spaces ahead of the next record,
+// such as those written between records by Writer.RecordSeparator. It returns
+// the number of bytes skipped.
+func skipWhitespace(r *bufio.Reader) (int, error) {
+	n := 0
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		if !isRecordSpace(c) {
+			return n, r.UnreadByte()
+		}
+		n++
+	}
+}
+
+func isRecordSpace(c byte) bool {
+	return c == '\n' || c == '\r' || c == ' ' || c == '\t'
+}
+
+// readRecord reads a single record, starting at offset in the stream. If
+// allowMissingRT is set, a record that ends the stream one byte short,
+// lacking only its record terminator, is accepted and the terminator
+// restored. Any other record longer than the rest of the stream is reported
+// by an error wrapping io.ErrUnexpectedEOF.
+func readRecord(r io.Reader, offset uint64, allowMissingRT bool) (int, []byte, error) {
 	tmp := make([]byte, 5)
 
-	_, e := r.Read(tmp)
+	_, e := io.ReadFull(r, tmp)
 	if e != nil {
 		return 0, nil, e
 	}
 
-	rlen := decodeDecimal(tmp)
-	if rlen < leaderSize+2 || rlen > maxRecordSize {
+	rlen, e := DecodeDecimal(tmp)
+	if e != nil || rlen < leaderSize+2 || rlen > maxRecordSize {
 		// (I think) the minimal size for a 'valid' record is the
 		// size of the leader with a field terminator (ending the
 		// directory) and the record terminator.
@@ -374,8 +1653,13 @@ func readRecord(r io.Reader) (int, []byte, error) {
 
 	result := make([]byte, rlen)
 	copy(result, tmp)
-	_, e = r.Read(result[5:])
-	if e != nil {
+	n, e := io.ReadFull(r, result[5:])
+	if e == io.ErrUnexpectedEOF && allowMissingRT && n == rlen-6 && result[rlen-2] == fieldTerminator {
+		result[rlen-1] = recordTerminator
+	} else if e == io.EOF || e == io.ErrUnexpectedEOF {
+		return 0, nil, fmt.Errorf("marc21: record at offset %d declares %d bytes but only %d are available: %w",
+			offset, rlen, 5+n, io.ErrUnexpectedEOF)
+	} else if e != nil {
 		return 0, nil, e
 	}
 
@@ -386,6 +1670,17 @@ func readRecord(r io.Reader) (int, []byte, error) {
 	return rlen, result, nil
 }
 
+// DecodeDecimal decodes a string of ASCII digits, such as the record length
+// or a directory entry. It returns an error if any byte is not a digit.
+func DecodeDecimal(n []byte) (int, error) {
+	for i := range n {
+		if n[i] < '0' || n[i] > '9' {
+			return 0, fmt.Errorf("marc21: %q is not a decimal number", n)
+		}
+	}
+	return decodeDecimal(n), nil
+}
+
 func decodeDecimal(n []byte) int {
 	result := 0
 	for i := range n {
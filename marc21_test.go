@@ -16,6 +16,10 @@ package marc21
 
 import (
 	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
 	"strings"
 	"testing"
 )
@@ -32,7 +36,7 @@ const (
 func TestReadRecord(t *testing.T) {
 	d := strings.NewReader(fullRecord)
 
-	n, rec, e := readRecord(d)
+	n, rec, e := readRecord(d, 0, false)
 	if e != nil {
 		t.Fatalf("Unable to read record: %v", e)
 	}
@@ -61,7 +65,10 @@ func TestLeaderValidation(t *testing.T) {
 }
 
 func TestDirectoryLoader(t *testing.T) {
-	d := decodeDirectory([]byte(fullRecord))
+	d, err := decodeDirectory([]byte(fullRecord))
+	if err != nil {
+		t.Fatalf("Unable to decode directory: %v", err)
+	}
 
 	if len(d) != 11 {
 		t.Errorf("Invalid entry count in directory")
@@ -127,6 +134,22 @@ func TestRawSubFieldExtraction(t *testing.T) {
 	}
 }
 
+func TestRawSubfieldMissingTerminator(t *testing.T) {
+	field := VariableField{Tag: "245", rawData: [][]byte{[]byte("10\x1faGarden exhibition /")}}
+
+	if subfield := field.GetNthRawSubfield("c", 0); subfield != nil {
+		t.Errorf("Got a value for 245$c, which doesn't exist: %q", subfield)
+	}
+	if subfield := field.GetNthRawSubfield("a", 0); string(subfield) != "Garden exhibition /" {
+		t.Errorf("Value returned for unterminated 245$a is wrong: %q", subfield)
+	}
+
+	field.rawData[0] = []byte("10")
+	if subfield := field.GetNthRawSubfield("a", 0); subfield != nil {
+		t.Errorf("Got a value from an instance with no data: %q", subfield)
+	}
+}
+
 func TestSubFieldExtraction(t *testing.T) {
 	// don't validate leader, just to make sure that works
 	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
@@ -157,3 +180,1055 @@ func TestGetSubfields(t *testing.T) {
 		t.Errorf("Second subfield should be 'c', got '%v'", ids[1])
 	}
 }
+
+func TestGetFieldsInRange(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	fields := m.GetFieldsInRange("600", "699")
+
+	if len(fields) != 1 {
+		t.Fatalf("6xx range should have 1 field, got %d", len(fields))
+	}
+	if fields[0].Tag != "650" {
+		t.Errorf("6xx range should return 650, got %v", fields[0].Tag)
+	}
+	if fields[0].ValueCount() != 1 {
+		t.Errorf("Range field should hold a single instance")
+	}
+}
+
+func TestFirstSubfieldOf(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+
+	if v := m.FirstSubfieldOf("a", "245", "240", "130"); v != "Garden exhibition /" {
+		t.Errorf("Expected 245$a, got %v", v)
+	}
+	if v := m.FirstSubfieldOf("a", "240", "710"); v != "San Francisco Museum of Art." {
+		t.Errorf("Expected fallback to 710$a, got %v", v)
+	}
+	if v := m.FirstSubfieldOf("a", "240", "130"); v != "" {
+		t.Errorf("Expected no value, got %v", v)
+	}
+}
+
+func TestTrimISBD(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	field := m.GetRawField("245")
+
+	if v := field.GetNthSubfieldTrimmed("a", 0); v != "Garden exhibition" {
+		t.Errorf("Trimmed 245$a is wrong: %v", v)
+	}
+	if v := field.GetNthSubfield("a", 0); v != "Garden exhibition /" {
+		t.Errorf("Untrimmed 245$a should be unchanged: %v", v)
+	}
+	if v := TrimISBD(" San Francisco : "); v != "San Francisco" {
+		t.Errorf("Trimmed value is wrong: %v", v)
+	}
+}
+
+func TestGetRawFieldData(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+
+	data := m.GetRawFieldData("245")
+	if len(data) != 1 {
+		t.Fatalf("Expected 1 instance of 245, got %d", len(data))
+	}
+	if !bytes.Equal(data[0], []byte(titleStatement[:len(titleStatement)-1])) {
+		t.Errorf("Field data should lack the terminator: %q", data[0])
+	}
+
+	field := m.GetRawField("245")
+	if raw := field.GetRawValue(0); raw[len(raw)-1] != fieldTerminator {
+		t.Errorf("GetRawField should keep the terminator")
+	}
+}
+
+func TestDecodeDecimalValidation(t *testing.T) {
+	if v, err := DecodeDecimal([]byte("00458")); err != nil || v != 458 {
+		t.Errorf("Conversion of \"00458\" should be 458, got %v (%v)", v, err)
+	}
+	if _, err := DecodeDecimal([]byte("0a458")); err == nil {
+		t.Errorf("Conversion of \"0a458\" should fail")
+	}
+
+	// a corrupt length must not be decoded into a bogus value
+	_, _, err := readRecord(strings.NewReader("0a458"+fullRecord[5:]), 0, false)
+	if err != errInvalidLength {
+		t.Errorf("Non-digit record length should be invalid, got %v", err)
+	}
+}
+
+func TestParseSafe(t *testing.T) {
+	if _, err := ParseSafe([]byte(fullRecord)); err != nil {
+		t.Errorf("Unable to parse valid record: %v", err)
+	}
+	if _, err := ParseSafe([]byte(fullRecord[:30])); err == nil {
+		t.Errorf("Truncated record should not parse")
+	}
+	if _, err := ParseSafe([]byte("00026")); err == nil {
+		t.Errorf("Short record should not parse")
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add([]byte(fullRecord))
+	f.Add([]byte(fullRecord[:leaderSize+2]))
+	f.Add([]byte(strings.Replace(fullRecord, "001001200000", "001000000000", 1)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// bypass ParseSafe's recover so that panics are reported
+		m, err := NewMarcRecord(data, false, 0)
+		if err != nil {
+			return
+		}
+		for _, tag := range m.GetFieldList() {
+			field := m.GetRawField(tag)
+			for i := 0; i < field.ValueCount(); i++ {
+				for _, code := range field.GetSubfields(i) {
+					field.GetNthSubfield(code, i)
+					field.GetNthRawSubfield(code, i)
+				}
+				sr := field.SubfieldReader(i)
+				for _, _, ok := sr.Next(); ok; _, _, ok = sr.Next() {
+				}
+				field.GetIndicators(i)
+				field.LinkTag(i)
+				field.IsRightToLeft(i)
+			}
+			if IsControlFieldTag(tag) {
+				m.GetControlField(tag)
+			}
+		}
+		m.MarshalJSON()
+		m.Flatten()
+		m.ToDTO()
+		NewMrkWriter(io.Discard).Write(m)
+		for _, e := range []Encoding{MARC8, UTF8} {
+			w := NewWriter(io.Discard)
+			w.OutputEncoding(e)
+			w.DropEmptyFields(true)
+			w.Write(m)
+		}
+
+		// the editing methods, which change m
+		m.Bytes()
+		m.RepairFieldTerminators()
+		m.StripVernacular()
+		m.RenumberLinks()
+		m.Canonicalize()
+		for _, tag := range m.GetFieldList() {
+			m.DeleteSubfields(tag, "a")
+		}
+	})
+}
+
+func TestDirectoryLoaderCorrupt(t *testing.T) {
+	// drop half of the last directory entry
+	short := []byte(fullRecord[:12] + "00151" + fullRecord[17:150] + fullRecord[156:])
+	if _, err := decodeDirectory(short); err != errDirectoryTruncated {
+		t.Errorf("Truncated directory should fail, got %v", err)
+	}
+
+	// overwrite the directory terminator
+	unterminated := []byte(fullRecord)
+	unterminated[156] = '0'
+	if _, err := decodeDirectory(unterminated); err != errNoDirectoryTerminator {
+		t.Errorf("Unterminated directory should fail, got %v", err)
+	}
+	if _, err := NewMarcRecord(unterminated, false, 0); err == nil {
+		t.Errorf("Record with unterminated directory should not parse")
+	}
+
+	// a directory running off the end of the record
+	if _, err := decodeDirectory([]byte(fullRecord[:100])); err == nil {
+		t.Errorf("Directory past end of record should not decode")
+	}
+}
+
+func TestImplicitSubfield(t *testing.T) {
+	// the 245 without the delimiter ahead of $a
+	field := VariableField{"245", [][]byte{[]byte(titleStatement[:2] + titleStatement[4:])}, utf8Transcoder, delimiters{}}
+
+	if v := field.GetNthSubfield("a", 0); v != "Garden exhibition /" {
+		t.Errorf("Implicit 245$a is wrong: %v", v)
+	}
+	if v := field.GetNthSubfield("c", 0); v != "San Francisco Museum of Art." {
+		t.Errorf("245$c after implicit $a is wrong: %v", v)
+	}
+	if ids := field.GetSubfields(0); len(ids) != 2 || ids[0] != "a" {
+		t.Errorf("Subfield list should include implicit $a: %v", ids)
+	}
+
+	// control fields have no subfields, implicit or not
+	m008 := VariableField{"008", [][]byte{[]byte("821202|1937    |||||||  |||| |0||||eng|d\x1e")}, utf8Transcoder, delimiters{}}
+	if ids := m008.GetSubfields(0); len(ids) != 0 {
+		t.Errorf("008 should have no subfields: %v", ids)
+	}
+	if v := m008.GetNthRawSubfield("a", 0); v != nil {
+		t.Errorf("008 should have no $a, got %q", v)
+	}
+
+	// an instance with nothing after its indicators has no implicit $a
+	empty := VariableField{"245", [][]byte{[]byte("00\x1e")}, utf8Transcoder, delimiters{}}
+	if v := empty.GetNthRawSubfield("a", 0); v != nil {
+		t.Errorf("Empty 245 should have no $a, got %q", v)
+	}
+	m, _ := NewRecordBuilder().
+		AddDataField("245", '0', '0').
+		AddDataField("246", '3', ' ', Subfield{"a", "Varying title"}).
+		Build()
+	if v := m.FirstSubfieldOf("a", "245", "246"); v != "Varying title" {
+		t.Errorf("FirstSubfieldOf should fall through an empty 245, got %q", v)
+	}
+}
+
+func TestFirstControlField(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	m.AddControlField("005", "20130101000000.0")
+
+	if _, err := m.GetControlField("005"); err == nil {
+		t.Errorf("Repeated 005 should be an error for GetControlField")
+	}
+	if v := m.FirstControlField("005"); v != "20120831093346.0" {
+		t.Errorf("First 005 is wrong: %v", v)
+	}
+	if v := m.FirstControlField("007"); v != "" {
+		t.Errorf("Missing 007 should be empty, got %v", v)
+	}
+}
+
+func TestLeaderError(t *testing.T) {
+	bad := []byte(fullRecord)
+	bad[6] = 'x'
+	bad[19] = 'z'
+
+	_, err := NewMarcRecord(bad, true, 0)
+	var le *LeaderError
+	if !errors.As(err, &le) {
+		t.Fatalf("Expected a LeaderError, got %v", err)
+	}
+	if len(le.Positions) != 2 || le.Positions[0] != 6 || le.Positions[1] != 19 {
+		t.Errorf("Failing positions should be [6 19], got %v", le.Positions)
+	}
+
+	if _, err = NewMarcRecord(bad, false, 0); err != nil {
+		t.Errorf("Leader should not be checked without validation: %v", err)
+	}
+}
+
+func TestGetSubfield(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	m.AddDataField("650", ' ', '0', Subfield{"x", "Catalogs."})
+
+	if v := m.GetSubfield("650", "a"); v != "Horticultural exhibitions." {
+		t.Errorf("650$a is wrong: %v", v)
+	}
+	if v := m.GetSubfield("650", "x"); v != "Catalogs." {
+		t.Errorf("650$x from the second instance is wrong: %v", v)
+	}
+	if v := m.GetSubfield("650", "z"); v != "" {
+		t.Errorf("Missing 650$z should be empty, got %v", v)
+	}
+}
+
+func TestSetTranscoder(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	field := m.GetRawField("245")
+
+	field.SetTranscoder(func(b []byte) (string, error) {
+		return strings.ToUpper(string(b)), nil
+	})
+	if v := field.GetNthSubfield("a", 0); v != "GARDEN EXHIBITION /" {
+		t.Errorf("Custom transcoder was not used: %v", v)
+	}
+
+	field = m.GetRawField("245")
+	if v := field.GetNthSubfield("a", 0); v != "Garden exhibition /" {
+		t.Errorf("Custom transcoder leaked to another field: %v", v)
+	}
+}
+
+func TestLeaderByte(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+
+	if b, err := m.LeaderByte(17); err != nil || b != '7' {
+		t.Errorf("Leader position 17 should be '7', got %q (%v)", b, err)
+	}
+	if _, err := m.LeaderByte(24); err == nil {
+		t.Errorf("Leader position 24 should be out of range")
+	}
+	if _, err := m.LeaderByte(-1); err == nil {
+		t.Errorf("Leader position -1 should be out of range")
+	}
+
+	truncated := &MarcRecord{RawRecord: []byte(fullRecord[:10])}
+	if _, err := truncated.LeaderByte(16); err == nil {
+		t.Errorf("Truncated leader should be an error")
+	}
+}
+
+func TestSubfieldInventory(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+
+	inv := m.SubfieldInventory()
+	if codes := inv["245"]; len(codes) != 2 || codes[0] != "a" || codes[1] != "c" {
+		t.Errorf("245 inventory should be [a c], got %v", codes)
+	}
+
+	m.AddDataField("245", '0', '0', Subfield{"a", "Other title"}, Subfield{"b", "subtitle"})
+	inv = m.SubfieldInventory()
+	if codes := inv["245"]; len(codes) != 3 || codes[0] != "a" || codes[1] != "b" || codes[2] != "c" {
+		t.Errorf("245 inventory should be [a b c], got %v", codes)
+	}
+	if _, ok := inv["001"]; ok {
+		t.Errorf("Control fields should not be in the inventory")
+	}
+	if len(inv) != 8 {
+		t.Errorf("Inventory should have 8 data fields, got %d", len(inv))
+	}
+}
+
+func TestFieldsByBlock(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	blocks := m.FieldsByBlock()
+
+	if subjects := blocks[BlockSubjects]; len(subjects) != 1 || subjects[0].Tag != "650" {
+		t.Errorf("Subjects block should hold the 650, got %v", subjects)
+	}
+	if n := len(blocks[BlockControl]); n != 3 {
+		t.Errorf("Control block should have 3 fields, got %d", n)
+	}
+	if f := blocks[BlockEditionImprint]; len(f) != 1 || f[0].Tag != "260" {
+		t.Errorf("Edition and imprint block should hold the 260")
+	}
+	if n := len(blocks[BlockLocal]); n != 2 {
+		t.Errorf("Local block should have 2 fields, got %d", n)
+	}
+}
+
+func TestDirectoryEntries(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	entries := m.DirectoryEntries()
+
+	if len(entries) != 11 {
+		t.Fatalf("Directory should have 11 entries, got %d", len(entries))
+	}
+	if e := entries[0]; e.Tag != "001" || e.Length != 12 || e.StartPos != 0 {
+		t.Errorf("First entry should be 001 of length 12 at 0, got %v", e)
+	}
+	if e := entries[10]; e.Tag != "906" || e.StartPos != 293 {
+		t.Errorf("Last entry should be 906 at 293, got %v", e)
+	}
+}
+
+func TestFieldTags(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	tags := m.FieldTags()
+
+	// fullRecord has 11 fields, none repeated
+	if len(tags) != 11 || tags[0] != "001" || tags[10] != "906" {
+		t.Fatalf("FieldTags should list the 11 fields 001 ... 906, got %v", tags)
+	}
+
+	m, _ = NewRecordBuilder().
+		AddDataField("650", ' ', '0', Subfield{"a", "Gardens"}).
+		AddDataField("245", '0', '0', Subfield{"a", "Title"}).
+		AddDataField("650", ' ', '0', Subfield{"a", "Exhibitions"}).
+		Build()
+	if tags := strings.Join(m.FieldTags(), " "); tags != "650 245 650" {
+		t.Errorf("FieldTags should keep order and repeats, got %q", tags)
+	}
+}
+
+func TestDirectoryEntryOffsets(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	e := m.DirectoryEntries()[4]
+
+	if e.Tag != "245" || e.StartPos != 86 {
+		t.Fatalf("245 should start at relative position 86, got %v", e)
+	}
+	if e.Offset != 157+86 {
+		t.Errorf("245 absolute offset should be %d, got %d", 157+86, e.Offset)
+	}
+	if string(m.RawRecord[e.Offset:e.Offset+e.Length]) != titleStatement {
+		t.Errorf("Absolute offset does not address the 245 data")
+	}
+	field := m.GetRawField("245")
+	if !bytes.Equal(field.GetRawValue(0), m.RawRecord[e.Offset:e.Offset+e.Length]) {
+		t.Errorf("GetRawField disagrees with the directory entry")
+	}
+}
+
+func TestGetFieldInstances(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	m.AddDataField("650", ' ', '0', Subfield{"a", "Gardens."})
+
+	fields := m.GetFieldInstances("650")
+	if len(fields) != 2 {
+		t.Fatalf("Expected 2 instances of 650, got %d", len(fields))
+	}
+	for _, f := range fields {
+		if f.ValueCount() != 1 {
+			t.Errorf("Each instance should hold a single value")
+		}
+	}
+	if v := fields[1].GetNthSubfield("a", 0); v != "Gardens." {
+		t.Errorf("Second 650$a is wrong: %v", v)
+	}
+	if len(m.GetFieldInstances("999")) != 0 {
+		t.Errorf("Missing field should have no instances")
+	}
+}
+
+func TestLinkTag(t *testing.T) {
+	field := VariableField{"880", [][]byte{
+		[]byte("10\x1f6245-01\x1faTitle\x1e"),
+		[]byte("10\x1f6245-02/(S/r\x1faTitle\x1e"),
+		[]byte("10\x1faTitle\x1e"),
+		[]byte("10\x1f624501\x1faTitle\x1e"),
+	}, utf8Transcoder, delimiters{}}
+
+	if tag, occ := field.LinkTag(0); tag != "245" || occ != 1 {
+		t.Errorf("$6 245-01 parsed as %v, %v", tag, occ)
+	}
+	if tag, occ := field.LinkTag(1); tag != "245" || occ != 2 {
+		t.Errorf("$6 with script suffix parsed as %v, %v", tag, occ)
+	}
+	if tag, occ := field.LinkTag(2); tag != "" || occ != 0 {
+		t.Errorf("Missing $6 should parse as empty, got %v, %v", tag, occ)
+	}
+	if tag, occ := field.LinkTag(3); tag != "" || occ != 0 {
+		t.Errorf("Malformed $6 should parse as empty, got %v, %v", tag, occ)
+	}
+}
+
+func TestIsRightToLeft(t *testing.T) {
+	field := VariableField{"880", [][]byte{
+		[]byte("10\x1f6245-01/(2/r\x1fa\u05d2\u05df\x1e"),
+		[]byte("10\x1f6245-02/(N\x1faTitle\x1e"),
+		[]byte("10\x1faTitle\x1e"),
+	}, utf8Transcoder, delimiters{}}
+
+	if !field.IsRightToLeft(0) {
+		t.Errorf("Hebrew 880 marked /r should be right-to-left")
+	}
+	if field.IsRightToLeft(1) || field.IsRightToLeft(2) {
+		t.Errorf("Fields without the orientation code should be left-to-right")
+	}
+}
+
+func TestVisibleString(t *testing.T) {
+	if v := VisibleString([]byte(titleStatement)); v != `00\x1faGarden exhibition /\x1fcSan Francisco Museum of Art.\x1e` {
+		t.Errorf("Escaped 245 is wrong: %v", v)
+	}
+	if v := VisibleString([]byte("Café \\ \xff")); v != `Café \\ \xff` {
+		t.Errorf("Escaped value is wrong: %v", v)
+	}
+}
+
+func TestNewReaderAuto(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(fullRecord + fullRecord + fullRecord))
+	zw.Close()
+
+	for _, data := range [][]byte{buf.Bytes(), []byte(fullRecord + fullRecord + fullRecord)} {
+		r, err := NewReaderAuto(bytes.NewReader(data), true)
+		if err != nil {
+			t.Fatalf("Unable to create reader: %v", err)
+		}
+		count := 0
+		for m, err := range r.All() {
+			if err != nil {
+				t.Fatalf("Unable to read record: %v", err)
+			}
+			if m.ControlNumber() != "000000002-7" {
+				t.Errorf("Record read incorrectly")
+			}
+			count++
+		}
+		if count != 3 {
+			t.Errorf("Expected 3 records, got %d", count)
+		}
+	}
+}
+
+func TestRawLength(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	field := m.GetRawField("245")
+
+	entry := m.DirectoryEntries()[4]
+	if n := field.RawLength(0); n != entry.Length || n != len(titleStatement) {
+		t.Errorf("245 raw length %d does not match directory length %d", n, entry.Length)
+	}
+}
+
+func TestJoinSubfield(t *testing.T) {
+	m, _ := NewRecordBuilder().
+		AddDataField("650", ' ', '0', Subfield{"a", "Gardens"}, Subfield{"a", "Exhibitions"}, Subfield{"z", "California"}).
+		Build()
+
+	field := m.GetRawField("650")
+	if s := field.JoinSubfield("a", 0, "--"); s != "Gardens--Exhibitions" {
+		t.Errorf("Joined $a should be \"Gardens--Exhibitions\", got %q", s)
+	}
+	if s := field.JoinSubfield("x", 0, "--"); s != "" {
+		t.Errorf("Joining a missing subfield should give \"\", got %q", s)
+	}
+}
+
+func TestGetSubfieldsByCodes(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	field := m.GetRawField("245")
+
+	values := field.GetSubfieldsByCodes(0, "c", "b", "a")
+	if len(values) != 3 {
+		t.Fatalf("Expected 3 values, got %d", len(values))
+	}
+	if values[0] != "San Francisco Museum of Art." || values[1] != "" || values[2] != "Garden exhibition /" {
+		t.Errorf("Values are not in requested order: %q", values)
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	data := []byte(fullRecord + "\n" + fullRecord)
+
+	records, err := ParseAll(data, true)
+	if err != nil {
+		t.Fatalf("Unable to parse records: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+	if records[1].Offset != uint64(fullRecordLen+1) {
+		t.Errorf("Second record offset is wrong: %d", records[1].Offset)
+	}
+	if &records[1].RawRecord[0] != &data[fullRecordLen+1] {
+		t.Errorf("Records should alias the input")
+	}
+
+	if _, err := ParseAll(data[:len(data)-10], false); err != io.ErrUnexpectedEOF {
+		t.Errorf("Truncated input should be an error, got %v", err)
+	}
+}
+
+func TestTruncatedRecord(t *testing.T) {
+	data := fullRecord + "\n" + fullRecord[:100]
+
+	r := NewReader(strings.NewReader(data), true)
+	r.Next()
+	_, err := r.Next()
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Truncated record should be an unexpected EOF, got %v", err)
+	}
+	want := fmt.Sprintf("offset %d declares %d bytes but only 100 are available", fullRecordLen+1, fullRecordLen)
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("Error %q should contain %q", err, want)
+	}
+}
+
+func TestAllowMissingFinalTerminator(t *testing.T) {
+	data := fullRecord + fullRecord[:fullRecordLen-1]
+
+	r := NewReader(strings.NewReader(data), true)
+	r.Next()
+	if _, err := r.Next(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Missing terminator should fail by default, got %v", err)
+	}
+
+	r = NewReader(strings.NewReader(data), true)
+	r.AllowMissingFinalTerminator(true)
+	r.Next()
+	m, err := r.Next()
+	if err != nil || m == nil {
+		t.Fatalf("Missing final terminator should be accepted: %v", err)
+	}
+	if string(m.RawRecord) != fullRecord {
+		t.Errorf("Terminator should be restored")
+	}
+
+	// only the terminator may be missing
+	r = NewReader(strings.NewReader(fullRecord[:fullRecordLen-2]), true)
+	r.AllowMissingFinalTerminator(true)
+	if _, err := r.Next(); err == nil {
+		t.Errorf("Record missing more than the terminator should fail")
+	}
+}
+
+func TestGetIndicators(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+
+	field := m.GetRawField("650")
+	if ind := field.GetIndicators(0); ind != "#0" {
+		t.Errorf("650 indicators should be \"#0\", got %v", ind)
+	}
+	field = m.GetRawField("001")
+	if ind := field.GetIndicators(0); ind != "" {
+		t.Errorf("Control field 001 should have no indicators, got %v", ind)
+	}
+	short := VariableField{"245", [][]byte{[]byte("0\x1e")}, utf8Transcoder, delimiters{}}
+	if ind := short.GetIndicators(0); ind != "" {
+		t.Errorf("Short field should have no indicators, got %v", ind)
+	}
+}
+
+func TestFormatIndicator(t *testing.T) {
+	if s := FormatIndicator(IndicatorBlank); s != "#" {
+		t.Errorf("Blank indicator should display as \"#\", got %q", s)
+	}
+	if s := FormatIndicator('0'); s != "0" {
+		t.Errorf("Indicator '0' should display as \"0\", got %q", s)
+	}
+
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	if data := m.GetRawFieldData("650")[0]; data[0] != IndicatorBlank {
+		t.Errorf("650 first indicator should be stored as a space, got %q", data[0])
+	}
+	var buf bytes.Buffer
+	NewMrkWriter(&buf).Write(m)
+	if !strings.Contains(buf.String(), "=650  \\0$aHorticultural exhibitions.\n") {
+		t.Errorf("Blank .mrk indicator should be a backslash:\n%s", buf.String())
+	}
+}
+
+func TestCollapseWhitespace(t *testing.T) {
+	spaced := strings.Replace(fullRecord, "Garden exhibition /", " Garden  exhibition", 1)
+
+	r := NewReader(strings.NewReader(spaced+spaced), false)
+	m, _ := r.Next()
+	field := m.GetRawField("245")
+	if v := field.GetNthSubfield("a", 0); v != " Garden  exhibition" {
+		t.Errorf("Spaces should be preserved by default, got %q", v)
+	}
+
+	r.CollapseWhitespace(true)
+	m, _ = r.Next()
+	field = m.GetRawField("245")
+	if v := field.GetNthSubfield("a", 0); v != "Garden exhibition" {
+		t.Errorf("Spaces should be collapsed, got %q", v)
+	}
+	if raw := field.GetNthRawSubfield("a", 0); string(raw) != " Garden  exhibition" {
+		t.Errorf("Raw data should be unchanged, got %q", raw)
+	}
+}
+
+func TestImplementationDefinedEntries(t *testing.T) {
+	// rebuild fullRecord with a two character implementation-defined part
+	// in each directory entry
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	dir := ""
+	for _, e := range m.DirectoryEntries() {
+		dir += fmt.Sprintf("%s%04d%05dXY", e.Tag, e.Length, e.StartPos)
+	}
+	data := fullRecord[157:]
+	base := leaderSize + len(dir) + 1
+	leader := fmt.Sprintf("%05d", base+len(data)) + fullRecord[5:12] + fmt.Sprintf("%05d", base) + fullRecord[17:20] + "4520"
+	raw := leader + dir + "\x1e" + data
+
+	wide, err := NewMarcRecord([]byte(raw), false, 0)
+	if err != nil {
+		t.Fatalf("Unable to parse record with 14 byte entries: %v", err)
+	}
+	tags := wide.GetFieldList()
+	if len(tags) != 11 || tags[0] != "001" || tags[10] != "988" {
+		t.Errorf("Tags decoded incorrectly: %v", tags)
+	}
+	field := wide.GetRawField("245")
+	if v := field.GetNthSubfield("a", 0); v != "Garden exhibition /" {
+		t.Errorf("245$a is wrong: %v", v)
+	}
+
+	if e := wide.DirectoryEntries()[0]; string(e.ImplementationDefined) != "XY" {
+		t.Errorf("Implementation-defined part is wrong: %q", e.ImplementationDefined)
+	}
+
+	// the wide entries are not mistaken for a short leader
+	r := NewReader(strings.NewReader(raw), false)
+	r.PadShortLeaders(true)
+	if m, err := r.Next(); err != nil || string(m.RawRecord) != raw {
+		t.Errorf("Record with 14 byte entries should be read as is: %v", err)
+	}
+
+	// reserializing without a change must reproduce the record exactly
+	wide.DeleteSubfields("245", "z")
+	var buf bytes.Buffer
+	NewWriter(&buf).Write(wide)
+	if buf.String() != raw {
+		t.Errorf("Implementation-defined entries did not round trip:\n%q\n%q", buf.String(), raw)
+	}
+
+	wide.AddControlField("003", "DLC")
+	entries := wide.DirectoryEntries()
+	if string(entries[1].ImplementationDefined) != "  " || string(entries[2].ImplementationDefined) != "XY" {
+		t.Errorf("Added field should have a blank implementation-defined part: %v", entries[:3])
+	}
+}
+
+func TestValidateFields(t *testing.T) {
+	rules := map[string][]string{"245": {"a"}, "650": {"a"}, "100": {"a"}}
+
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+	if errs := m.ValidateFields(rules); len(errs) != 0 {
+		t.Errorf("fullRecord should satisfy the rules: %v", errs)
+	}
+
+	m.DeleteSubfields("245", "a")
+	errs := m.ValidateFields(rules)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "245") {
+		t.Errorf("Record missing 245 $a should fail validation: %v", errs)
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+	rows := m.Flatten()
+	if len(rows) != 15 {
+		t.Errorf("Expected 15 rows, got %d", len(rows))
+	}
+
+	found := false
+	for _, row := range rows {
+		if row.Tag == "245" && row.Code == "a" {
+			found = true
+			expected := SubfieldRow{"245", 0, "a", "Garden exhibition /", "0", "0"}
+			if row != expected {
+				t.Errorf("245 $a row is wrong: %+v", row)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("No 245 $a row")
+	}
+	if rows[0] != (SubfieldRow{Tag: "001", Value: "000000002-7"}) {
+		t.Errorf("001 row is wrong: %+v", rows[0])
+	}
+}
+
+func TestPadShortLeaders(t *testing.T) {
+	// fullRecord with leader positions 22-23 truncated
+	short := "00456nam a22001557u 45" + fullRecord[leaderSize:]
+
+	r := NewReader(strings.NewReader(short), true)
+	if _, err := r.Next(); err == nil {
+		t.Errorf("Record with a short leader should not validate")
+	}
+
+	r = NewReader(strings.NewReader(short+short), true)
+	r.PadShortLeaders(true)
+	for i := 0; i < 2; i++ {
+		m, err := r.Next()
+		if err != nil {
+			t.Fatalf("Padded record %d should validate, got %v", i, err)
+		}
+		if string(m.RawRecord) != fullRecord {
+			t.Errorf("Padded record is wrong: %q", m.GetLeader())
+		}
+	}
+
+	if m, err := ParseSafe([]byte(fullRecord)); err != nil || string(padLeader(m.RawRecord)) != fullRecord {
+		t.Errorf("Record with a full leader should not be padded")
+	}
+}
+
+func TestCharacterCodingScheme(t *testing.T) {
+	// the usual UTF-8 leader has position 08 (type of control) blank and the
+	// coding scheme 'a' in position 09
+	m, err := NewRecordBuilder().
+		SetLeader("00000nam a2200000   4500").
+		AddDataField("245", '1', '0', Subfield{"a", "Café"}).
+		Build()
+	if err != nil {
+		t.Fatalf("Unable to build record: %v", err)
+	}
+	if m.CharacterEncoding != 'a' {
+		t.Errorf("Coding scheme should be 'a', got %q", m.CharacterEncoding)
+	}
+	if v := m.GetSubfield("245", "a"); v != "Café" {
+		t.Errorf("UTF-8 245$a decodes as %q", v)
+	}
+}
+
+func TestUnknownEncoding(t *testing.T) {
+	unknown := fullRecord[:9] + "x" + fullRecord[10:]
+
+	if _, err := NewMarcRecord([]byte(unknown), false, 0); err != nil {
+		t.Errorf("Unknown encoding should fall back to UTF-8 by default, got %v", err)
+	}
+
+	r := NewReader(strings.NewReader(unknown), false)
+	r.UnknownEncoding(UnknownEncodingError)
+	if m, err := r.Next(); err == nil || m != nil {
+		t.Errorf("Unknown encoding should be rejected under UnknownEncodingError")
+	}
+
+	// 0xe2 is the MARC-8 acute accent, which is not valid UTF-8 on its own
+	marc8 := strings.Replace(unknown, "Garden", "Garde\xe2n", 1)
+	marc8 = strings.Replace(marc8, "exhibition", "exhibitio", 1)
+	for _, policy := range []UnknownEncodingPolicy{UnknownEncodingMARC8, UnknownEncodingDetect} {
+		r = NewReader(strings.NewReader(marc8), false)
+		r.UnknownEncoding(policy)
+		m, err := r.Next()
+		if err != nil {
+			t.Fatalf("Unable to read record under policy %d: %v", policy, err)
+		}
+		if title := m.GetSubfield("245", "a"); title != "Garde\u0144 exhibitio /" {
+			t.Errorf("Title decoded wrongly under policy %d: %q", policy, title)
+		}
+	}
+}
+
+func TestGetFieldsMatching(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+	m.AddDataField("650", ' ', '0', Subfield{"a", "Art museums."})
+	m.AddDataField("650", ' ', '7', Subfield{"a", "Horticultural exhibitions"}, Subfield{"2", "fast"})
+
+	horticultural := func(f *VariableField, i int) bool {
+		return strings.Contains(f.GetNthSubfield("a", i), "Horticultural")
+	}
+	fields := m.GetFieldsMatching("650", horticultural)
+	if len(fields) != 2 {
+		t.Fatalf("Expected 2 matching 650s, got %d", len(fields))
+	}
+	if fields[1].GetNthSubfield("2", 0) != "fast" {
+		t.Errorf("Second match is the wrong instance: %q", fields[1].GetRawValue(0))
+	}
+
+	if fields := m.GetFieldsMatching("651", horticultural); len(fields) != 0 {
+		t.Errorf("Missing tag should match nothing, got %d", len(fields))
+	}
+}
+
+func TestReaderPolicy(t *testing.T) {
+	// the 001's field terminator overwritten, so it runs into the 005
+	unterminated := fullRecord[:168] + "X" + fullRecord[169:]
+
+	if m, err := NewReader(strings.NewReader(unterminated), true).Next(); err != nil || m == nil {
+		t.Errorf("Record should parse without directory validation: %v", err)
+	}
+
+	p := Policy{ValidateLeader: true, ValidateDirectory: true}
+	r := NewReaderWithPolicy(strings.NewReader(fullRecord+unterminated), p)
+	if m, err := r.Next(); err != nil || m == nil {
+		t.Errorf("Valid record should pass directory validation: %v", err)
+	}
+	if _, err := r.Next(); err == nil || !strings.Contains(err.Error(), "001") {
+		t.Errorf("Unterminated field should fail directory validation, got %v", err)
+	}
+
+	p.RequiredSubfields = map[string][]string{"245": {"a", "b"}}
+	if _, err := NewReaderWithPolicy(strings.NewReader(fullRecord), p).Next(); err == nil {
+		t.Errorf("Record missing 245 $b should fail the required subfields")
+	}
+}
+
+func TestSubfieldReader(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+	field := m.GetRawField("260")
+
+	expected := []string{"aSan Francisco :", "bThe Museum,", "c[1937]"}
+	sr := field.SubfieldReader(0)
+	for i, e := range expected {
+		code, value, ok := sr.Next()
+		if !ok {
+			t.Fatalf("Reader ended after %d subfields", i)
+		}
+		if string(code)+string(value) != e {
+			t.Errorf("Subfield %d is wrong: $%c %q", i, code, value)
+		}
+	}
+	if _, _, ok := sr.Next(); ok {
+		t.Errorf("Reader should be exhausted after $c")
+	}
+
+	control := m.GetRawField("001")
+	if _, _, ok := control.SubfieldReader(0).Next(); ok {
+		t.Errorf("Control fields have no subfields")
+	}
+}
+
+func TestZeroLengthControlField(t *testing.T) {
+	// the 001 directory entry with its length zeroed
+	corrupt := strings.Replace(fullRecord, "001001200000", "001000000000", 1)
+	m, err := NewMarcRecord([]byte(corrupt), false, 0)
+	if err != nil {
+		t.Fatalf("Unable to parse record: %v", err)
+	}
+	if cf, err := m.GetControlField("001"); cf != "" || err != nil {
+		t.Errorf("Zero length 001 should be empty, got %q, %v", cf, err)
+	}
+	if cn := m.ControlNumber(); cn != "" {
+		t.Errorf("Control number should be empty, got %q", cn)
+	}
+}
+
+func TestIsControlFieldTag(t *testing.T) {
+	tests := map[string]bool{"001": true, "008": true, "245": false, "0": false, "": false}
+	for tag, expected := range tests {
+		if IsControlFieldTag(tag) != expected {
+			t.Errorf("IsControlFieldTag(%q) should be %v", tag, expected)
+		}
+	}
+}
+
+func TestReaderSkipsBOM(t *testing.T) {
+	r := NewReader(strings.NewReader("\xef\xbb\xbf"+fullRecord+fullRecord), true)
+	m, err := r.Next()
+	if err != nil || m == nil {
+		t.Fatalf("Unable to read record after a BOM: %v", err)
+	}
+	if m.Offset != 3 {
+		t.Errorf("Offset should count the BOM, got %d", m.Offset)
+	}
+	if m, err = r.Next(); err != nil || m == nil || m.Offset != uint64(3+fullRecordLen) {
+		t.Errorf("Unable to read second record: %v", err)
+	}
+}
+
+func TestOverrunTolerance(t *testing.T) {
+	// the last field, 906, claims one byte more than it has
+	overrun := strings.Replace(fullRecord, "906000700293", "906000800293", 1)
+
+	if _, err := NewReader(strings.NewReader(overrun), true).Next(); err != errInvalidDirectory {
+		t.Errorf("Overrunning entry should be rejected by default, got %v", err)
+	}
+
+	r := NewReaderWithPolicy(strings.NewReader(overrun), Policy{ValidateLeader: true, OverrunTolerance: 1})
+	m, err := r.Next()
+	if err != nil {
+		t.Fatalf("Overrun within tolerance should be clamped, got %v", err)
+	}
+	if string(m.RawRecord) != fullRecord {
+		t.Errorf("Clamped record is wrong: %q", m.RawRecord)
+	}
+
+	gross := strings.Replace(fullRecord, "906000700293", "906001000293", 1)
+	r = NewReaderWithPolicy(strings.NewReader(gross), Policy{OverrunTolerance: 1})
+	if _, err := r.Next(); err != errInvalidDirectory {
+		t.Errorf("Overrun beyond tolerance should be rejected, got %v", err)
+	}
+}
+
+func TestSubfieldCount(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+	field := m.GetRawField("245")
+	if n := field.SubfieldCount("a", 0); n != 1 {
+		t.Errorf("245 should have one $a, got %d", n)
+	}
+	if n := field.SubfieldCount("b", 0); n != 0 {
+		t.Errorf("245 should have no $b, got %d", n)
+	}
+}
+
+func TestLeaderRules(t *testing.T) {
+	p := Policy{ValidateLeader: true, LeaderRules: map[int]string{18: "i"}}
+
+	// fullRecord's position 18 is 'u'
+	var le *LeaderError
+	if _, err := NewReaderWithPolicy(strings.NewReader(fullRecord), p).Next(); !errors.As(err, &le) || len(le.Positions) != 1 || le.Positions[0] != 18 {
+		t.Errorf("Record violating the local rule should be rejected, got %v", err)
+	}
+
+	rda := fullRecord[:18] + "i" + fullRecord[19:]
+	if m, err := NewReaderWithPolicy(strings.NewReader(rda), p).Next(); err != nil || m == nil {
+		t.Errorf("Record satisfying the local rule should be accepted, got %v", err)
+	}
+
+	// removing the built-in rule for position 6 accepts a local record type
+	local := fullRecord[:6] + "x" + fullRecord[7:]
+	p.LeaderRules = map[int]string{6: ""}
+	if m, err := NewReaderWithPolicy(strings.NewReader(local), p).Next(); err != nil || m == nil {
+		t.Errorf("Removed rule should not be enforced, got %v", err)
+	}
+}
+
+func TestVernacularField(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord[:8]+"a"+fullRecord[9:]), true, 0)
+	m.AddDataField("880", '1', '0', Subfield{"6", "245-01/(N"}, Subfield{"a", "Выставка садов /"})
+	m.AddDataField("880", '2', ' ', Subfield{"6", "710-02/(N"}, Subfield{"a", "Музей"})
+
+	f := m.VernacularField("245", 1)
+	if f == nil {
+		t.Fatalf("No vernacular 245")
+	}
+	if v := f.GetNthSubfield("a", 0); v != "Выставка садов /" {
+		t.Errorf("Vernacular 245 $a is wrong: %q", v)
+	}
+	if f.GetIndicators(0) != "10" {
+		t.Errorf("Vernacular 245 indicators are wrong: %q", f.GetIndicators(0))
+	}
+	if m.VernacularField("245", 2) != nil || m.VernacularField("710", 1) != nil {
+		t.Errorf("Unlinked tag and occurrence should have no vernacular field")
+	}
+}
+
+func TestGetDataFieldValues(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+	m.AddDataField("650", ' ', '0', Subfield{"a", "Art museums"}, Subfield{"z", "California"}, Subfield{"v", "Exhibitions."})
+
+	if v := m.GetDataFieldValues("650", "a", "; ", " -- "); v != "Horticultural exhibitions.; Art museums" {
+		t.Errorf("Joined 650 $a is wrong: %q", v)
+	}
+	if v := m.GetDataFieldValues("650", "avz", "; ", " -- "); v != "Horticultural exhibitions.; Art museums -- California -- Exhibitions." {
+		t.Errorf("Joined 650 $a$v$z is wrong: %q", v)
+	}
+	if v := m.GetDataFieldValues("651", "a", "; ", " -- "); v != "" {
+		t.Errorf("Missing tag should join to nothing, got %q", v)
+	}
+}
+
+func TestGetRawValueOutOfRange(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+	field := m.GetRawField("245")
+
+	if v := field.GetRawValue(field.ValueCount()); v != nil {
+		t.Errorf("Out of range instance should be nil, got %q", v)
+	}
+	if v := field.GetRawValue(-1); v != nil {
+		t.Errorf("Negative instance should be nil, got %q", v)
+	}
+	if v := field.GetNthSubfield("a", field.ValueCount()); v != "" {
+		t.Errorf("Out of range subfield should be empty, got %q", v)
+	}
+	if ind := field.GetIndicators(field.ValueCount()); ind != "" {
+		t.Errorf("Out of range indicators should be empty, got %q", ind)
+	}
+}
+
+func TestCustomSubfieldDelimiter(t *testing.T) {
+	dollar := strings.Replace(fullRecord, "\x1f", "$", -1)
+
+	m, err := NewReaderWithPolicy(strings.NewReader(dollar), Policy{SubfieldDelimiter: '$'}).Next()
+	if err != nil {
+		t.Fatalf("Unable to read record: %v", err)
+	}
+	field := m.GetRawField("245")
+	if v := field.GetNthSubfield("c", 0); v != "San Francisco Museum of Art." {
+		t.Errorf("245 $c is wrong: %q", v)
+	}
+	if codes := field.GetSubfields(0); len(codes) != 2 || codes[0] != "a" || codes[1] != "c" {
+		t.Errorf("245 subfield codes are wrong: %v", codes)
+	}
+	if v := m.GetDataFieldValues("260", "abc", "", " "); v != "San Francisco : The Museum, [1937]" {
+		t.Errorf("260 values are wrong: %q", v)
+	}
+	found := false
+	for _, row := range m.Flatten() {
+		if row.Tag == "245" && row.Code == "c" {
+			found = row.Value == "San Francisco Museum of Art."
+		}
+	}
+	if !found {
+		t.Errorf("Flatten should split on the policy delimiter")
+	}
+	if err := m.DeleteSubfields("245", "c"); err != nil {
+		t.Fatalf("Unable to delete subfields: %v", err)
+	}
+	field = m.GetRawField("245")
+	if codes := field.GetSubfields(0); len(codes) != 1 || field.GetNthSubfield("a", 0) != "Garden exhibition /" {
+		t.Errorf("245 after deleting $c is wrong: %v", codes)
+	}
+
+	m, _ = NewMarcRecord([]byte(dollar), false, 0)
+	field = m.GetRawField("245")
+	if v := field.GetNthSubfield("c", 0); v != "" {
+		t.Errorf("Without the policy '$' should not delimit subfields, got %q", v)
+	}
+}
@@ -0,0 +1,396 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MARC-8 character sets are identified by the final character of their
+// escape sequences, per http://www.loc.gov/marc/specifications/speccharmarc8.html .
+// Only the Latin and Greek sets are supported; text in any other set
+// (Cyrillic, Hebrew, Arabic, CJK) is decoded as U+FFFD with an error.
+const (
+	setBasicLatin  = 'B'
+	setANSEL       = 'E'
+	setGreek       = 'S'
+	setSubscript   = 'b'
+	setSuperscript = 'p'
+	setGreekSymbol = 'g'
+)
+
+const escape = 0x1b
+
+// marc8Sets maps each supported set, other than Basic Latin, to its
+// characters at code points 0x21 -- 0x7E. Sets used as G1 are shifted up by
+// 0x80.
+var marc8Sets = map[byte]map[byte]rune{
+	setANSEL: {
+		0x21: 'Ł', 0x22: 'Ø', 0x23: 'Đ', 0x24: 'Þ', 0x25: 'Æ', 0x26: 'Œ',
+		0x27: 'ʹ', 0x28: '·', 0x29: '♭', 0x2A: '®', 0x2B: '±', 0x2C: 'Ơ',
+		0x2D: 'Ư', 0x2E: 'ʼ', 0x30: 'ʻ', 0x31: 'ł', 0x32: 'ø', 0x33: 'đ',
+		0x34: 'þ', 0x35: 'æ', 0x36: 'œ', 0x37: 'ʺ', 0x38: 'ı', 0x39: '£',
+		0x3A: 'ð', 0x3C: 'ơ', 0x3D: 'ư', 0x40: '°', 0x41: 'ℓ', 0x42: '℗',
+		0x43: '©', 0x44: '♯', 0x45: '¿', 0x46: '¡', 0x47: 'ß', 0x48: '€',
+		// combining marks
+		0x60: '\u0309', 0x61: '\u0300', 0x62: '\u0301', 0x63: '\u0302',
+		0x64: '\u0303', 0x65: '\u0304', 0x66: '\u0306', 0x67: '\u0307',
+		0x68: '\u0308', 0x69: '\u030C', 0x6A: '\u030A', 0x6B: '\uFE20',
+		0x6C: '\uFE21', 0x6D: '\u0315', 0x6E: '\u030B', 0x6F: '\u0310',
+		0x70: '\u0327', 0x71: '\u0328', 0x72: '\u0323', 0x73: '\u0324',
+		0x74: '\u0325', 0x75: '\u0333', 0x76: '\u0332', 0x77: '\u0326',
+		0x78: '\u031C', 0x79: '\u032E', 0x7A: '\uFE22', 0x7B: '\uFE23',
+		0x7E: '\u0313',
+	},
+	setGreek: {
+		// combining marks
+		0x21: '\u0301', 0x22: '\u0300', 0x23: '\u0308', 0x24: '\u0342',
+		0x25: '\u0313', 0x26: '\u0314', 0x27: '\u0345',
+		0x30: '«', 0x31: '»', 0x32: '“', 0x33: '”', 0x34: '\u0374', 0x35: '\u0375',
+		0x3B: '\u0387', 0x3F: '\u037E',
+		0x41: 'Α', 0x42: 'Β', 0x44: 'Γ', 0x45: 'Δ', 0x46: 'Ε', 0x47: 'Ϛ',
+		0x48: 'Ϝ', 0x49: 'Ζ', 0x4A: 'Η', 0x4B: 'Θ', 0x4C: 'Ι', 0x4D: 'Κ',
+		0x4E: 'Λ', 0x4F: 'Μ', 0x50: 'Ν', 0x51: 'Ξ', 0x52: 'Ο', 0x53: 'Π',
+		0x54: 'Ϟ', 0x55: 'Ρ', 0x56: 'Σ', 0x58: 'Τ', 0x59: 'Υ', 0x5A: 'Φ',
+		0x5B: 'Χ', 0x5C: 'Ψ', 0x5D: 'Ω', 0x5E: 'Ϡ',
+		0x61: 'α', 0x62: 'β', 0x63: 'ϐ', 0x64: 'γ', 0x65: 'δ', 0x66: 'ε',
+		0x67: 'ϛ', 0x68: 'ϝ', 0x69: 'ζ', 0x6A: 'η', 0x6B: 'θ', 0x6C: 'ι',
+		0x6D: 'κ', 0x6E: 'λ', 0x6F: 'μ', 0x70: 'ν', 0x71: 'ξ', 0x72: 'ο',
+		0x73: 'π', 0x74: 'ϟ', 0x75: 'ρ', 0x76: 'σ', 0x77: 'ς', 0x78: 'τ',
+		0x79: 'υ', 0x7A: 'φ', 0x7B: 'χ', 0x7C: 'ψ', 0x7D: 'ω', 0x7E: 'ϡ',
+	},
+	setSubscript: {
+		0x28: '₍', 0x29: '₎', 0x2B: '₊', 0x2D: '₋',
+		0x30: '₀', 0x31: '₁', 0x32: '₂', 0x33: '₃', 0x34: '₄',
+		0x35: '₅', 0x36: '₆', 0x37: '₇', 0x38: '₈', 0x39: '₉',
+	},
+	setSuperscript: {
+		0x28: '⁽', 0x29: '⁾', 0x2B: '⁺', 0x2D: '⁻',
+		0x30: '⁰', 0x31: '¹', 0x32: '²', 0x33: '³', 0x34: '⁴',
+		0x35: '⁵', 0x36: '⁶', 0x37: '⁷', 0x38: '⁸', 0x39: '⁹',
+	},
+	setGreekSymbol: {
+		0x61: 'α', 0x62: 'β', 0x63: 'γ',
+	},
+}
+
+// newMARC8Transcoder returns a MARC-8 transcoder whose working sets start as
+// g0 and g1 for each value it decodes.
+func newMARC8Transcoder(g0, g1 byte) Transcoder {
+	return func(bytes []byte) (string, error) {
+		return decodeMARC8(bytes, g0, g1)
+	}
+}
+
+var marc8Transcoder = newMARC8Transcoder(setBasicLatin, setANSEL)
+
+// decodeMARC8 transcodes MARC-8 text to UTF-8, following escape sequences
+// that change the working sets and moving combining marks, which MARC-8
+// places before the base character, after it as Unicode requires. A base
+// character and marks with a precomposed form in marc8Decompositions are
+// recomposed, so text encoded by encodeMARC8 decodes as it was. Unknown
+// characters are decoded as U+FFFD and reported by the returned error.
+func decodeMARC8(bytes []byte, g0, g1 byte) (string, error) {
+	var err error
+	out := make([]rune, 0, len(bytes))
+	marks := make([]rune, 0)
+
+	for i := 0; i < len(bytes); i++ {
+		c := bytes[i]
+		if c == escape {
+			n, g, set := parseEscape(bytes[i:])
+			if n == 0 {
+				err = fmt.Errorf("marc21: invalid MARC-8 escape sequence at %d", i)
+				continue
+			}
+			if g == 0 {
+				g0 = set
+			} else {
+				g1 = set
+			}
+			i += n - 1
+			continue
+		}
+
+		var r rune
+		ok := true
+		switch {
+		case c <= ' ' || c == 0x7f:
+			r = rune(c)
+		case c < 0x80:
+			r, ok = marc8Rune(g0, c)
+		case c > 0xa0 && c < 0xff:
+			r, ok = marc8Rune(g1, c-0x80)
+		default:
+			ok = false
+		}
+		if !ok {
+			r = utf8.RuneError
+			err = fmt.Errorf("marc21: unsupported MARC-8 character 0x%02x", c)
+		}
+
+		if unicode.Is(unicode.Mn, r) {
+			marks = append(marks, r)
+			continue
+		}
+		out = append(out, compose(r, marks)...)
+		marks = marks[:0]
+	}
+	out = append(out, marks...)
+
+	return string(out), err
+}
+
+func marc8Rune(set byte, c byte) (rune, bool) {
+	if set == setBasicLatin {
+		return rune(c), true
+	}
+	r, ok := marc8Sets[set][c]
+	return r, ok
+}
+
+// parseEscape decodes the escape sequence at the start of b, returning its
+// length, the working set (0 or 1) it designates, and the character set. The
+// length is 0 if the sequence is invalid.
+func parseEscape(b []byte) (int, int, byte) {
+	if len(b) < 2 {
+		return 0, 0, 0
+	}
+	switch b[1] {
+	case setSubscript, setSuperscript, setGreekSymbol:
+		return 2, 0, b[1]
+	case 's':
+		return 2, 0, setBasicLatin
+	}
+
+	n := 1
+	if b[n] == '$' {
+		// multibyte set; the G0 intermediate is optional
+		n++
+		if n < len(b) && b[n] != '(' && b[n] != ',' && b[n] != ')' && b[n] != '-' {
+			return n + 1, 0, b[n]
+		}
+	}
+	if n+1 >= len(b) {
+		return 0, 0, 0
+	}
+	g := 0
+	switch b[n] {
+	case '(', ',':
+	case ')', '-':
+		g = 1
+	default:
+		return 0, 0, 0
+	}
+	n++
+	if b[n] == '!' && n+1 < len(b) {
+		// ANSEL is designated as "!E"
+		n++
+	}
+	return n + 1, g, b[n]
+}
+
+// alternateGraphicTranscoder returns a MARC-8 transcoder whose default
+// working sets are the primary G0 ($a) and G1 ($b) sets declared in field 066,
+// or Basic Latin and ANSEL when the record has no 066.
+func (m *MarcRecord) alternateGraphicTranscoder() Transcoder {
+	g0, g1 := byte(setBasicLatin), byte(setANSEL)
+	field := m.GetRawField("066")
+	if field.ValueCount() > 0 {
+		if a := field.GetNthRawSubfield("a", 0); len(a) > 0 {
+			g0 = a[len(a)-1]
+		}
+		if b := field.GetNthRawSubfield("b", 0); len(b) > 0 {
+			g1 = b[len(b)-1]
+		}
+	}
+	if g0 == setBasicLatin && g1 == setANSEL {
+		return marc8Transcoder
+	}
+	return newMARC8Transcoder(g0, g1)
+}
+
+// marc8Decompositions gives the MARC-8 encodable decomposition of the Latin
+// and Greek precomposed characters, since MARC-8 can only represent them as
+// a base character and combining marks.
+var marc8Decompositions = map[rune]string{
+	'À': "A\u0300", 'Á': "A\u0301", 'Â': "A\u0302", 'Ã': "A\u0303",
+	'Ä': "A\u0308", 'Å': "A\u030A", 'Ç': "C\u0327", 'È': "E\u0300",
+	'É': "E\u0301", 'Ê': "E\u0302", 'Ë': "E\u0308", 'Ì': "I\u0300",
+	'Í': "I\u0301", 'Î': "I\u0302", 'Ï': "I\u0308", 'Ñ': "N\u0303",
+	'Ò': "O\u0300", 'Ó': "O\u0301", 'Ô': "O\u0302", 'Õ': "O\u0303",
+	'Ö': "O\u0308", 'Ù': "U\u0300", 'Ú': "U\u0301", 'Û': "U\u0302",
+	'Ü': "U\u0308", 'Ý': "Y\u0301", 'à': "a\u0300", 'á': "a\u0301",
+	'â': "a\u0302", 'ã': "a\u0303", 'ä': "a\u0308", 'å': "a\u030A",
+	'ç': "c\u0327", 'è': "e\u0300", 'é': "e\u0301", 'ê': "e\u0302",
+	'ë': "e\u0308", 'ì': "i\u0300", 'í': "i\u0301", 'î': "i\u0302",
+	'ï': "i\u0308", 'ñ': "n\u0303", 'ò': "o\u0300", 'ó': "o\u0301",
+	'ô': "o\u0302", 'õ': "o\u0303", 'ö': "o\u0308", 'ù': "u\u0300",
+	'ú': "u\u0301", 'û': "u\u0302", 'ü': "u\u0308", 'ý': "y\u0301",
+	'ÿ': "y\u0308", 'Ā': "A\u0304", 'ā': "a\u0304", 'Ă': "A\u0306",
+	'ă': "a\u0306", 'Ą': "A\u0328", 'ą': "a\u0328", 'Ć': "C\u0301",
+	'ć': "c\u0301", 'Ĉ': "C\u0302", 'ĉ': "c\u0302", 'Ċ': "C\u0307",
+	'ċ': "c\u0307", 'Č': "C\u030C", 'č': "c\u030C", 'Ď': "D\u030C",
+	'ď': "d\u030C", 'Ē': "E\u0304", 'ē': "e\u0304", 'Ĕ': "E\u0306",
+	'ĕ': "e\u0306", 'Ė': "E\u0307", 'ė': "e\u0307", 'Ę': "E\u0328",
+	'ę': "e\u0328", 'Ě': "E\u030C", 'ě': "e\u030C", 'Ĝ': "G\u0302",
+	'ĝ': "g\u0302", 'Ğ': "G\u0306", 'ğ': "g\u0306", 'Ġ': "G\u0307",
+	'ġ': "g\u0307", 'Ģ': "G\u0327", 'ģ': "g\u0327", 'Ĥ': "H\u0302",
+	'ĥ': "h\u0302", 'Ĩ': "I\u0303", 'ĩ': "i\u0303", 'Ī': "I\u0304",
+	'ī': "i\u0304", 'Ĭ': "I\u0306", 'ĭ': "i\u0306", 'Į': "I\u0328",
+	'į': "i\u0328", 'İ': "I\u0307", 'Ĵ': "J\u0302", 'ĵ': "j\u0302",
+	'Ķ': "K\u0327", 'ķ': "k\u0327", 'Ĺ': "L\u0301", 'ĺ': "l\u0301",
+	'Ļ': "L\u0327", 'ļ': "l\u0327", 'Ľ': "L\u030C", 'ľ': "l\u030C",
+	'Ń': "N\u0301", 'ń': "n\u0301", 'Ņ': "N\u0327", 'ņ': "n\u0327",
+	'Ň': "N\u030C", 'ň': "n\u030C", 'Ō': "O\u0304", 'ō': "o\u0304",
+	'Ŏ': "O\u0306", 'ŏ': "o\u0306", 'Ő': "O\u030B", 'ő': "o\u030B",
+	'Ŕ': "R\u0301", 'ŕ': "r\u0301", 'Ŗ': "R\u0327", 'ŗ': "r\u0327",
+	'Ř': "R\u030C", 'ř': "r\u030C", 'Ś': "S\u0301", 'ś': "s\u0301",
+	'Ŝ': "S\u0302", 'ŝ': "s\u0302", 'Ş': "S\u0327", 'ş': "s\u0327",
+	'Š': "S\u030C", 'š': "s\u030C", 'Ţ': "T\u0327", 'ţ': "t\u0327",
+	'Ť': "T\u030C", 'ť': "t\u030C", 'Ũ': "U\u0303", 'ũ': "u\u0303",
+	'Ū': "U\u0304", 'ū': "u\u0304", 'Ŭ': "U\u0306", 'ŭ': "u\u0306",
+	'Ů': "U\u030A", 'ů': "u\u030A", 'Ű': "U\u030B", 'ű': "u\u030B",
+	'Ų': "U\u0328", 'ų': "u\u0328", 'Ŵ': "W\u0302", 'ŵ': "w\u0302",
+	'Ŷ': "Y\u0302", 'ŷ': "y\u0302", 'Ÿ': "Y\u0308", 'Ź': "Z\u0301",
+	'ź': "z\u0301", 'Ż': "Z\u0307", 'ż': "z\u0307", 'Ž': "Z\u030C",
+	'ž': "z\u030C", 'Ά': "Α\u0301", '·': "·", 'Έ': "Ε\u0301",
+	'Ή': "Η\u0301", 'Ί': "Ι\u0301", 'Ό': "Ο\u0301", 'Ύ': "Υ\u0301",
+	'Ώ': "Ω\u0301", 'ΐ': "ι\u0308\u0301", 'Ϊ': "Ι\u0308", 'Ϋ': "Υ\u0308",
+	'ά': "α\u0301", 'έ': "ε\u0301", 'ή': "η\u0301", 'ί': "ι\u0301",
+	'ΰ': "υ\u0308\u0301", 'ϊ': "ι\u0308", 'ϋ': "υ\u0308", 'ό': "ο\u0301",
+	'ύ': "υ\u0301", 'ώ': "ω\u0301",
+}
+
+// marc8Compositions is the inverse of marc8Decompositions.
+var marc8Compositions = func() map[string]rune {
+	compositions := make(map[string]rune)
+	for r, d := range marc8Decompositions {
+		if d != string(r) {
+			compositions[d] = r
+		}
+	}
+	return compositions
+}()
+
+// compose returns base followed by marks, with base and as many of the
+// leading marks as possible replaced by their precomposed character.
+func compose(base rune, marks []rune) []rune {
+	for k := len(marks); k > 0; k-- {
+		if r, ok := marc8Compositions[string(base)+string(marks[:k])]; ok {
+			return append([]rune{r}, marks[k:]...)
+		}
+	}
+	return append([]rune{base}, marks...)
+}
+
+// A marc8Code is where a character is found in MARC-8: the set, whether it is
+// used as G0 or G1, and its code point within the set.
+type marc8Code struct {
+	set  byte
+	g    int
+	code byte
+}
+
+// marc8Codes is the inverse of marc8Sets. A character found in more than one
+// set is encoded in ANSEL, which is always G1, in preference to a set that
+// needs an escape sequence.
+var marc8Codes = func() map[rune]marc8Code {
+	codes := make(map[rune]marc8Code)
+	for set, chars := range marc8Sets {
+		for c, r := range chars {
+			code := marc8Code{set, 0, c}
+			if set == setANSEL {
+				code = marc8Code{set, 1, c + 0x80}
+			}
+			if old, ok := codes[r]; ok && (old.set == setANSEL || old.set < set) {
+				continue
+			}
+			codes[r] = code
+		}
+	}
+	return codes
+}()
+
+// encodeMARC8 encodes UTF-8 text as MARC-8, starting and ending with Basic
+// Latin as G0 and ANSEL as G1. Escape sequences are emitted inline where the
+// text needs another G0 set, and the sets used are added to used. Combining
+// marks are moved ahead of their base characters.
+func encodeMARC8(s string, used map[byte]bool) ([]byte, error) {
+	runes := make([]rune, 0, len(s))
+	for _, r := range s {
+		if d, ok := marc8Decompositions[r]; ok {
+			runes = append(runes, []rune(d)...)
+		} else {
+			runes = append(runes, r)
+		}
+	}
+
+	out := make([]byte, 0, len(s))
+	g0 := byte(setBasicLatin)
+	emit := func(r rune) error {
+		if r < 0x80 {
+			if r > ' ' && r != 0x7f && g0 != setBasicLatin {
+				out = append(out, escape, '(', setBasicLatin)
+				g0 = setBasicLatin
+			}
+			out = append(out, byte(r))
+			return nil
+		}
+		code, ok := marc8Codes[r]
+		if !ok {
+			return fmt.Errorf("marc21: %U cannot be encoded in MARC-8", r)
+		}
+		if code.g == 0 && code.set != g0 {
+			out = append(out, designateMARC8(code.set)...)
+			g0 = code.set
+			used[code.set] = true
+		}
+		out = append(out, code.code)
+		return nil
+	}
+
+	for i := 0; i < len(runes); {
+		// find the marks that follow the base character
+		j := i + 1
+		for j < len(runes) && unicode.Is(unicode.Mn, runes[j]) {
+			j++
+		}
+		for _, r := range runes[i+1 : j] {
+			if err := emit(r); err != nil {
+				return nil, err
+			}
+		}
+		if err := emit(runes[i]); err != nil {
+			return nil, err
+		}
+		i = j
+	}
+	if g0 != setBasicLatin {
+		out = append(out, escape, '(', setBasicLatin)
+	}
+	return out, nil
+}
+
+// designateMARC8 returns the escape sequence making set the G0 set.
+func designateMARC8(set byte) []byte {
+	switch set {
+	case setSubscript, setSuperscript, setGreekSymbol:
+		return []byte{escape, set}
+	}
+	return []byte{escape, '(', set}
+}
@@ -0,0 +1,65 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"testing"
+)
+
+func TestMARC8Transcoder(t *testing.T) {
+	// ANSEL acute precedes its base character
+	if v, err := marc8Transcoder([]byte("Caf\xe2e")); err != nil || v != "Café" {
+		t.Errorf("ANSEL decoding is wrong: %q (%v)", v, err)
+	}
+	if v, _ := marc8Transcoder([]byte("\xa5sop")); v != "Æsop" {
+		t.Errorf("ANSEL spacing character is wrong: %q", v)
+	}
+
+	// switch G0 to Greek and back to Basic Latin
+	if v, err := marc8Transcoder([]byte("Title \x1b(Sabd\x1b(B 1937")); err != nil || v != "Title αβγ 1937" {
+		t.Errorf("Greek escape decoding is wrong: %q (%v)", v, err)
+	}
+	if v, _ := marc8Transcoder([]byte("H\x1bb2\x1bsO")); v != "H₂O" {
+		t.Errorf("Subscript decoding is wrong: %q", v)
+	}
+
+	// Cyrillic is not supported
+	if _, err := marc8Transcoder([]byte("\x1b(Nabc")); err == nil {
+		t.Errorf("Unsupported set should be an error")
+	}
+}
+
+func TestAlternateGraphicRepresentation(t *testing.T) {
+	m, err := NewRecordBuilder().
+		SetLeader("00000nam  2200000   4500").
+		AddControlField("001", "greek-1").
+		AddDataField("066", ' ', ' ', Subfield{"a", "(S"}).
+		AddDataField("245", '0', '0', Subfield{"a", "abd"}).
+		Build()
+	if err != nil {
+		t.Fatalf("Unable to build record: %v", err)
+	}
+
+	field := m.GetRawField("245")
+	if v := field.GetNthSubfield("a", 0); v != "αβγ" {
+		t.Errorf("066 default G0 set was not used: %q", v)
+	}
+
+	m, _ = NewMarcRecord([]byte(fullRecord), false, 0)
+	field = m.GetRawField("245")
+	if v := field.GetNthSubfield("a", 0); v != "Garden exhibition /" {
+		t.Errorf("Record without 066 should decode as Basic Latin: %q", v)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// mrkBlank stands for a space in the MARCMaker leader, control fields and
+// indicators.
+const mrkBlank = `\`
+
+// mrkDollar stands for a literal "$" in a MARCMaker subfield value.
+const mrkDollar = "{dollar}"
+
+// A MrkWriter writes records in the MARCMaker line format (.mrk), one field
+// per line:
+//
+//	=LDR  00458nam\a22001577u\4500
+//	=001  000000002-7
+//	=245  10$aGarden exhibition /$cSan Francisco Museum of Art.
+//
+// Records are followed by a blank line. Values are decoded, so the leader's
+// character coding scheme (position 09) is given as UTF-8 whatever the
+// record's encoding.
+type MrkWriter struct {
+	w io.Writer
+}
+
+func NewMrkWriter(w io.Writer) *MrkWriter {
+	return &MrkWriter{w}
+}
+
+// Write writes a single record.
+func (w *MrkWriter) Write(m *MarcRecord) error {
+	var buf bytes.Buffer
+
+	leader := []byte(m.GetLeader())
+	leader[9] = byte(UTF8)
+	writeMrkLine(&buf, "LDR", strings.Replace(string(leader), " ", mrkBlank, -1))
+
+	_, ft := m.delims.get()
+	entries, _ := decodeEntries(m.RawRecord)
+	for _, e := range entries {
+		data := m.RawRecord[e.offset : e.offset+e.length]
+		if len(data) > 0 && data[len(data)-1] == ft {
+			data = data[:len(data)-1]
+		}
+		if IsControlFieldTag(e.tag) {
+			value, err := m.decoder(data)
+			if err != nil {
+				return err
+			}
+			writeMrkLine(&buf, e.tag, strings.Replace(value, " ", mrkBlank, -1))
+			continue
+		}
+
+		var line strings.Builder
+		for i := 0; i < 2; i++ {
+			if i < len(data) {
+				line.WriteString(formatIndicator(data[i], mrkBlank))
+			} else {
+				line.WriteString(mrkBlank)
+			}
+		}
+		if len(data) > 2 {
+			for _, sf := range subfieldChunks(append(data[2:len(data):len(data)], ft), m.delims) {
+				value, err := m.decoder(sf[1:])
+				if err != nil {
+					return err
+				}
+				line.WriteByte('$')
+				line.WriteByte(sf[0])
+				line.WriteString(strings.Replace(value, "$", mrkDollar, -1))
+			}
+		}
+		writeMrkLine(&buf, e.tag, line.String())
+	}
+	buf.WriteByte('\n')
+
+	_, err := w.w.Write(buf.Bytes())
+	return err
+}
+
+func writeMrkLine(buf *bytes.Buffer, tag, value string) {
+	buf.WriteByte('=')
+	buf.WriteString(tag)
+	buf.WriteString("  ")
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// A MrkReader reads records in the MARCMaker line format written by a
+// MrkWriter. Records are delimited by blank lines; the record length and
+// base address in the leader are recomputed.
+type MrkReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+func NewMrkReader(r io.Reader) *MrkReader {
+	return &MrkReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next record. Like Reader.Next, it returns a nil record and
+// a nil error when there are none left.
+func (r *MrkReader) Next() (*MarcRecord, error) {
+	b := NewRecordBuilder()
+	fields := 0
+	for {
+		line, err := r.r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line != "" {
+			r.line++
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			if fields > 0 {
+				return b.Build()
+			}
+			if err == io.EOF {
+				return nil, nil
+			}
+			continue
+		}
+		if perr := r.parseLine(b, line); perr != nil {
+			return nil, perr
+		}
+		fields++
+		if err == io.EOF {
+			return b.Build()
+		}
+	}
+}
+
+// parseLine adds the field on a single line to b.
+func (r *MrkReader) parseLine(b *RecordBuilder, line string) error {
+	if len(line) < 6 || line[0] != '=' || line[4:6] != "  " {
+		return fmt.Errorf("marc21: .mrk line %d is malformed", r.line)
+	}
+	tag, value := line[1:4], line[6:]
+
+	if tag == "LDR" {
+		b.SetLeader(strings.Replace(value, mrkBlank, " ", -1))
+		return nil
+	}
+	if IsControlFieldTag(tag) {
+		b.AddControlField(tag, strings.Replace(value, mrkBlank, " ", -1))
+		return nil
+	}
+
+	if len(value) < 2 {
+		return fmt.Errorf("marc21: .mrk line %d has no indicators", r.line)
+	}
+	ind := strings.Replace(value[:2], mrkBlank, " ", -1)
+	if len(ind) != 2 {
+		return fmt.Errorf("marc21: .mrk line %d has malformed indicators", r.line)
+	}
+	subfields := make([]Subfield, 0)
+	for _, chunk := range strings.Split(value[2:], "$")[1:] {
+		if chunk == "" {
+			continue
+		}
+		subfields = append(subfields, Subfield{chunk[:1], strings.Replace(chunk[1:], mrkDollar, "$", -1)})
+	}
+	b.AddDataField(tag, ind[0], ind[1], subfields...)
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMrkWriter(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+
+	var buf bytes.Buffer
+	if err := NewMrkWriter(&buf).Write(m); err != nil {
+		t.Fatalf("Unable to write .mrk: %v", err)
+	}
+
+	expected := `=LDR  00458nam\a22001577u\4500
+=001  000000002-7
+=005  20120831093346.0
+=008  821202|1937\\\\|||||||\\||||\|0||||eng|d
+=035  0\$aocm83544809
+=245  00$aGarden exhibition /$cSan Francisco Museum of Art.
+=260  0\$aSan Francisco :$bThe Museum,$c[1937]
+=300  \\$a1 folded sheet (4p.) ;$c14 cm.
+=650  \0$aHorticultural exhibitions.
+=710  2\$aSan Francisco Museum of Art.
+=988  \\$a20020608
+=906  \\$0MH
+
+`
+	if buf.String() != expected {
+		t.Errorf(".mrk output is wrong:\n%s", buf.String())
+	}
+}
+
+func TestMrkRoundTrip(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+	m.AddDataField("856", '4', '0', Subfield{"u", "http://example.org/?p=$1"})
+
+	var buf bytes.Buffer
+	w := NewMrkWriter(&buf)
+	w.Write(m)
+	w.Write(m)
+
+	r := NewMrkReader(&buf)
+	for i := 0; i < 2; i++ {
+		read, err := r.Next()
+		if err != nil {
+			t.Fatalf("Unable to read record %d: %v", i, err)
+		}
+		if _, err := NewMarcRecord(read.RawRecord, true, 0); err != nil {
+			t.Errorf("Record built from .mrk is invalid: %v", err)
+		}
+		if read.GetLeader()[5:8] != "nam" || read.CharacterEncoding != 'a' {
+			t.Errorf("Leader is wrong: %q", read.GetLeader())
+		}
+		if !bytes.Equal(read.GetRawFieldData("008")[0], m.GetRawFieldData("008")[0]) {
+			t.Errorf("008 is wrong: %q", read.GetRawFieldData("008")[0])
+		}
+		if v := read.GetSubfield("245", "c"); v != "San Francisco Museum of Art." {
+			t.Errorf("245$c is wrong: %q", v)
+		}
+		if v := read.GetSubfield("856", "u"); v != "http://example.org/?p=$1" {
+			t.Errorf("856$u is wrong: %q", v)
+		}
+		field, _ := read.GetDataField("650")
+		if ind := field.GetIndicators(0); ind != "#0" {
+			t.Errorf("650 indicators are wrong: %q", ind)
+		}
+		if len(read.GetFieldList()) != len(m.GetFieldList()) {
+			t.Errorf("Field count is wrong: %v", read.GetFieldList())
+		}
+	}
+	if m, err := r.Next(); m != nil || err != nil {
+		t.Errorf("Expected no record and no error after the last record, got %v, %v", m, err)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// NewMultiReader returns a Reader over the records in each of rdrs in turn,
+// advancing to the next when one is exhausted. A record may not span two
+// readers. By default offsets continue across readers, as if they were
+// concatenated; see ResetOffsetPerSource.
+func NewMultiReader(validate bool, rdrs ...io.Reader) *Reader {
+	sources := make([]func() (io.Reader, io.Closer, error), len(rdrs))
+	for i := range rdrs {
+		rdr := rdrs[i]
+		sources[i] = func() (io.Reader, io.Closer, error) { return rdr, nil, nil }
+	}
+	return newMultiReader(validate, sources)
+}
+
+// NewMultiFileReader is like NewMultiReader for the files at paths. Each
+// file is opened only when the Reader reaches it, and closed when it is
+// exhausted; Close closes the current file if reading stops early. All the
+// files must exist when NewMultiFileReader is called.
+func NewMultiFileReader(paths []string, validate bool) (*Reader, error) {
+	sources := make([]func() (io.Reader, io.Closer, error), len(paths))
+	for i := range paths {
+		path := paths[i]
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+		sources[i] = func() (io.Reader, io.Closer, error) {
+			f, err := os.Open(path)
+			return f, f, err
+		}
+	}
+	return newMultiReader(validate, sources), nil
+}
+
+func newMultiReader(validate bool, sources []func() (io.Reader, io.Closer, error)) *Reader {
+	r := NewReader(eofReader{}, validate)
+	r.sources = sources
+	return r
+}
+
+// eofReader is an empty input, read before a multi-reader's first source.
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// ResetOffsetPerSource sets whether record offsets restart at zero with each
+// input of a multi-reader, rather than continuing across them.
+func (r *Reader) ResetOffsetPerSource(reset bool) {
+	r.resetOffset = reset
+}
+
+// Close closes the input currently being read if the Reader opened it, as
+// NewMultiFileReader does. It has no effect on other Readers.
+func (r *Reader) Close() error {
+	r.sources = nil
+	if r.closer == nil {
+		return nil
+	}
+	err := r.closer.Close()
+	r.closer = nil
+	return err
+}
+
+// advance closes the current input and opens the next.
+func (r *Reader) advance() error {
+	sources := r.sources[1:]
+	open := r.sources[0]
+	if err := r.Close(); err != nil {
+		return err
+	}
+	r.sources = sources
+
+	rdr, closer, err := open()
+	if err != nil {
+		return err
+	}
+	r.closer = closer
+	r.r = bufio.NewReader(rdr)
+	r.started = false
+	if r.resetOffset {
+		r.offset = 0
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMultiReader(t *testing.T) {
+	first := strings.NewReader(fullRecord + "\n" + fullRecord)
+	second := strings.NewReader(otherRecord)
+
+	r := NewMultiReader(true, first, strings.NewReader(""), second)
+	offsets := []uint64{0, uint64(fullRecordLen + 1), uint64(2*fullRecordLen + 1)}
+	for i, offset := range offsets {
+		m, err := r.Next()
+		if err != nil || m == nil {
+			t.Fatalf("Unable to read record %d: %v", i, err)
+		}
+		if m.Offset != offset {
+			t.Errorf("Record %d offset is %d, expected %d", i, m.Offset, offset)
+		}
+	}
+	if m, err := r.Next(); m != nil || err != nil {
+		t.Errorf("Expected end of input, got %v, %v", m, err)
+	}
+
+	r = NewMultiReader(true, strings.NewReader(fullRecord), strings.NewReader(otherRecord))
+	r.ResetOffsetPerSource(true)
+	r.Next()
+	if m, _ := r.Next(); m == nil || m.Offset != 0 || m.ControlNumber() != "000000003-7" {
+		t.Errorf("Second reader's first record should be at offset 0")
+	}
+}
+
+func TestMultiFileReader(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "a.mrc"), filepath.Join(dir, "b.mrc")}
+	os.WriteFile(paths[0], []byte(fullRecord), 0644)
+	os.WriteFile(paths[1], []byte(otherRecord), 0644)
+
+	r, err := NewMultiFileReader(paths, true)
+	if err != nil {
+		t.Fatalf("Unable to open files: %v", err)
+	}
+	count := 0
+	for _, err := range r.All() {
+		if err != nil {
+			t.Fatalf("Unable to read records: %v", err)
+		}
+		count++
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 records, got %d", count)
+	}
+
+	if _, err := NewMultiFileReader([]string{filepath.Join(dir, "missing.mrc")}, true); err == nil {
+		t.Errorf("Missing file should be an error")
+	}
+}
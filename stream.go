@@ -0,0 +1,275 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"iter"
+)
+
+// All returns an iterator over the remaining records in the stream. Iteration
+// stops after the first error, which is yielded with a nil record.
+func (r *Reader) All() iter.Seq2[*MarcRecord, error] {
+	return func(yield func(*MarcRecord, error) bool) {
+		for {
+			rec, err := r.Next()
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if rec == nil {
+				return
+			}
+			if !yield(rec, nil) {
+				return
+			}
+		}
+	}
+}
+
+// NextContext is like Next but returns ctx.Err() if ctx is cancelled before
+// the next record is read. The context is checked only before reading: a
+// Read that is already blocked is not interrupted, and a record read while
+// ctx is cancelled is still returned, so that none is lost by a caller that
+// resumes reading.
+func (r *Reader) NextContext(ctx context.Context) (*MarcRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.Next()
+}
+
+// A KeepPolicy selects which of several records sharing a control number
+// Dedupe emits.
+type KeepPolicy int
+
+const (
+	KeepFirst KeepPolicy = iota
+	KeepLast
+)
+
+// Dedupe reads the records in r and yields one record per control number
+// (001), chosen according to keep. Records without a 001 are always yielded.
+//
+// With KeepFirst records are yielded as they are read, and only the control
+// numbers seen so far are held in memory. With KeepLast nothing can be yielded
+// until the stream is exhausted, so every kept record is held in memory; the
+// records are then yielded in the order of their last occurrence.
+func Dedupe(r io.Reader, keep KeepPolicy) iter.Seq2[*MarcRecord, error] {
+	return func(yield func(*MarcRecord, error) bool) {
+		rdr := NewReader(r, false)
+
+		if keep == KeepFirst {
+			seen := make(map[string]bool)
+			for rec, err := range rdr.All() {
+				if err != nil {
+					yield(nil, err)
+					return
+				}
+				cn := rec.ControlNumber()
+				if cn != "" {
+					if seen[cn] {
+						continue
+					}
+					seen[cn] = true
+				}
+				if !yield(rec, nil) {
+					return
+				}
+			}
+			return
+		}
+
+		kept := make([]*MarcRecord, 0)
+		index := make(map[string]int)
+		for rec, err := range rdr.All() {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			cn := rec.ControlNumber()
+			if cn != "" {
+				if i, ok := index[cn]; ok {
+					kept[i] = nil
+				}
+				index[cn] = len(kept)
+			}
+			kept = append(kept, rec)
+		}
+		for _, rec := range kept {
+			if rec != nil && !yield(rec, nil) {
+				return
+			}
+		}
+	}
+}
+
+// A RecordFunc transforms a record. Returning a nil record drops it from the
+// stream.
+type RecordFunc func(*MarcRecord) (*MarcRecord, error)
+
+// Transform returns an iterator over the remaining records in the stream with
+// each of fns applied in order. A record dropped by one function is not passed
+// to the rest. Iteration stops after the first error, which is yielded with a
+// nil record.
+func (r *Reader) Transform(fns ...RecordFunc) iter.Seq2[*MarcRecord, error] {
+	return func(yield func(*MarcRecord, error) bool) {
+	records:
+		for rec, err := range r.All() {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			for _, fn := range fns {
+				rec, err = fn(rec)
+				if err != nil {
+					yield(nil, err)
+					return
+				}
+				if rec == nil {
+					continue records
+				}
+			}
+			if !yield(rec, nil) {
+				return
+			}
+		}
+	}
+}
+
+// A RecordError describes a record that could not be parsed, and where in the
+// stream it began.
+type RecordError struct {
+	Offset uint64
+	Err    error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("%v (record at offset %d)", e.Err, e.Offset)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// NextLenient is like Next, but a record that cannot be parsed does not end
+// the stream: it returns a nil record and a *RecordError, and the following
+// call returns the next record. Any other error is an I/O error from the
+// underlying reader, after which reading should stop.
+//
+// Records are delimited by their terminators rather than their length fields,
+// so the reader resynchronizes after a record with a corrupt length.
+func (r *Reader) NextLenient() (*MarcRecord, error) {
+	return r.each(r.nextLenient)
+}
+
+func (r *Reader) nextLenient() (*MarcRecord, error) {
+	r.skipBOM()
+	skipped, err := skipWhitespace(r.r)
+	r.offset += uint64(skipped)
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	raw, err := r.r.ReadBytes(recordTerminator)
+	offset := r.offset
+	r.offset += uint64(len(raw))
+	if err == io.EOF {
+		return nil, &RecordError{offset, errNoRecordTerminator}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if rlen, e := DecodeDecimal(raw[:min(5, len(raw))]); e != nil || rlen != len(raw) {
+		return nil, &RecordError{offset, errInvalidLength}
+	}
+	m, err := r.parse(raw, offset)
+	if err != nil {
+		return nil, &RecordError{offset, err}
+	}
+	return m, nil
+}
+
+// Stream reads the records in r in a new goroutine, sending each record that
+// parses on records and a RecordError for each one that does not, as
+// NextLenient does. Both channels are closed when the input is exhausted or
+// an I/O error, sent as a RecordError at the current offset, ends it. The
+// channels are unbuffered, so the caller must receive from both until they
+// are closed, for example with a select loop.
+func Stream(r io.Reader) (<-chan *MarcRecord, <-chan RecordError) {
+	records := make(chan *MarcRecord)
+	errs := make(chan RecordError)
+	go func() {
+		defer close(records)
+		defer close(errs)
+
+		rdr := NewReader(r, false)
+		for {
+			offset := rdr.offset
+			m, err := rdr.NextLenient()
+			if re, ok := err.(*RecordError); ok {
+				errs <- *re
+				continue
+			}
+			if err != nil {
+				errs <- RecordError{offset, err}
+				return
+			}
+			if m == nil {
+				return
+			}
+			records <- m
+		}
+	}()
+	return records, errs
+}
+
+// progressInterval is the number of records between the progress callbacks
+// made by ReadAllWithProgress.
+const progressInterval = 1000
+
+// ReadAllWithProgress reads every record in r into memory, calling cb with
+// the number of records and bytes read so far after every 1000 records and
+// at the end. Leader validation is off; use the Reader method to
+// configure the reader or the interval.
+func ReadAllWithProgress(r io.Reader, cb func(count int, bytes uint64)) ([]*MarcRecord, error) {
+	return NewReader(r, false).ReadAllWithProgress(progressInterval, cb)
+}
+
+// ReadAllWithProgress reads the remaining records in the stream into memory,
+// calling cb with the number of records and bytes read so far each time
+// another every records have been read, and once more at the end unless the
+// last of those calls already counted every record. On error the records
+// read so far are returned with it, and the final callback is not made.
+func (r *Reader) ReadAllWithProgress(every int, cb func(count int, bytes uint64)) ([]*MarcRecord, error) {
+	records := make([]*MarcRecord, 0)
+	for rec, err := range r.All() {
+		if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+		if every > 0 && len(records)%every == 0 {
+			cb(len(records), r.offset)
+		}
+	}
+	if every <= 0 || len(records) == 0 || len(records)%every != 0 {
+		cb(len(records), r.offset)
+	}
+	return records, nil
+}
@@ -0,0 +1,249 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// otherRecord is fullRecord with a different control number.
+var otherRecord = strings.Replace(fullRecord, "000000002-7", "000000003-7", 1)
+
+func TestDedupe(t *testing.T) {
+	data := fullRecord + otherRecord + fullRecord
+
+	for _, keep := range []KeepPolicy{KeepFirst, KeepLast} {
+		ids := make([]string, 0)
+		for rec, err := range Dedupe(strings.NewReader(data), keep) {
+			if err != nil {
+				t.Fatalf("Unable to read records: %v", err)
+			}
+			ids = append(ids, rec.ControlNumber())
+		}
+		if len(ids) != 2 {
+			t.Fatalf("Dedupe should emit 2 records, got %d", len(ids))
+		}
+		if keep == KeepFirst && ids[0] != "000000002-7" {
+			t.Errorf("KeepFirst should emit the duplicate first, got %v", ids)
+		}
+		if keep == KeepLast && ids[0] != "000000003-7" {
+			t.Errorf("KeepLast should emit the duplicate last, got %v", ids)
+		}
+	}
+}
+
+func TestTransform(t *testing.T) {
+	// a copy of fullRecord without its 245
+	m, _ := NewMarcRecord([]byte(otherRecord), false, 0)
+	fields := make([]rawField, 0)
+	for _, f := range m.rawFields() {
+		if f.tag != "245" {
+			fields = append(fields, f)
+		}
+	}
+	untitled, _ := encodeRecord(m.RawRecord, fields)
+
+	requireTitle := func(m *MarcRecord) (*MarcRecord, error) {
+		if len(m.GetRawFieldData("245")) == 0 {
+			return nil, nil
+		}
+		return m, nil
+	}
+	addNote := func(m *MarcRecord) (*MarcRecord, error) {
+		err := m.AddDataField("500", ' ', ' ', Subfield{"a", "Transformed."})
+		return m, err
+	}
+
+	r := NewReader(strings.NewReader(fullRecord+string(untitled)+fullRecord), false)
+	count := 0
+	for rec, err := range r.Transform(requireTitle, addNote) {
+		if err != nil {
+			t.Fatalf("Unable to read records: %v", err)
+		}
+		if rec.ControlNumber() != "000000002-7" {
+			t.Errorf("Record without 245 was not dropped")
+		}
+		field := rec.GetRawField("500")
+		if field.GetNthSubfield("a", 0) != "Transformed." {
+			t.Errorf("Transformed record lacks the added 500")
+		}
+		count++
+	}
+	if count != 2 {
+		t.Errorf("Transform should yield 2 records, got %d", count)
+	}
+}
+
+func TestNextContext(t *testing.T) {
+	r := NewReader(strings.NewReader(fullRecord+fullRecord), false)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if m, err := r.NextContext(ctx); m == nil || err != nil {
+		t.Fatalf("Unable to read first record: %v", err)
+	}
+	cancel()
+	if m, err := r.NextContext(ctx); m != nil || err != context.Canceled {
+		t.Errorf("Expected context.Canceled after cancel, got %v", err)
+	}
+}
+
+// cancelingReader cancels a context when it is first read.
+type cancelingReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (c cancelingReader) Read(p []byte) (int, error) {
+	c.cancel()
+	return c.r.Read(p)
+}
+
+func TestNextContextCancelledDuringRead(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewReader(cancelingReader{strings.NewReader(fullRecord + otherRecord), cancel}, false)
+
+	// the record being read when ctx is cancelled is not lost
+	if m, err := r.NextContext(ctx); err != nil || m.ControlNumber() != "000000002-7" {
+		t.Fatalf("Record read during cancellation should be returned, got %v", err)
+	}
+	if m, err := r.NextContext(ctx); m != nil || err != context.Canceled {
+		t.Errorf("Expected context.Canceled after cancel, got %v", err)
+	}
+	if m, err := r.Next(); err != nil || m.ControlNumber() != "000000003-7" {
+		t.Errorf("Resuming should read the next record, got %v", err)
+	}
+}
+
+func TestNextLenient(t *testing.T) {
+	// the middle record's length field claims a few more bytes than it has
+	bad := "00462" + fullRecord[5:]
+	r := NewReader(strings.NewReader(fullRecord+bad+otherRecord), true)
+
+	m, err := r.NextLenient()
+	if err != nil || m.ControlNumber() != "000000002-7" {
+		t.Fatalf("Unable to read first record: %v", err)
+	}
+
+	m, err = r.NextLenient()
+	var re *RecordError
+	if m != nil || !errors.As(err, &re) {
+		t.Fatalf("Expected a RecordError for the bad record, got %v", err)
+	}
+	if re.Offset != uint64(fullRecordLen) || re.Err != errInvalidLength {
+		t.Errorf("RecordError is wrong: %v", re)
+	}
+
+	m, err = r.NextLenient()
+	if err != nil || m == nil || m.ControlNumber() != "000000003-7" {
+		t.Fatalf("Unable to read the record after the bad one: %v", err)
+	}
+	if m.Offset != uint64(2*fullRecordLen) {
+		t.Errorf("Offset after resync is wrong: %d", m.Offset)
+	}
+
+	if m, err = r.NextLenient(); m != nil || err != nil {
+		t.Errorf("Expected end of stream, got %v, %v", m, err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	bad := "00462" + fullRecord[5:]
+	records, errs := Stream(strings.NewReader(fullRecord + bad + otherRecord))
+
+	var got []*MarcRecord
+	var failed []RecordError
+	for records != nil || errs != nil {
+		select {
+		case m, ok := <-records:
+			if !ok {
+				records = nil
+				continue
+			}
+			got = append(got, m)
+		case re, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			failed = append(failed, re)
+		}
+	}
+
+	if len(got) != 2 || got[0].ControlNumber() != "000000002-7" || got[1].ControlNumber() != "000000003-7" {
+		t.Errorf("Expected the two good records, got %d", len(got))
+	}
+	if len(failed) != 1 || failed[0].Offset != uint64(fullRecordLen) || failed[0].Err != errInvalidLength {
+		t.Errorf("Expected one RecordError at offset %d, got %v", fullRecordLen, failed)
+	}
+}
+
+func TestReaderLimit(t *testing.T) {
+	r := NewReader(strings.NewReader(fullRecord+otherRecord+fullRecord), true)
+	r.Limit(2)
+
+	count := 0
+	for _, err := range r.All() {
+		if err != nil {
+			t.Fatalf("Unable to read records: %v", err)
+		}
+		count++
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 records, got %d", count)
+	}
+	if m, err := r.Next(); m != nil || err != nil {
+		t.Errorf("Reader should stay at its limit, got %v, %v", m, err)
+	}
+}
+
+func TestReadAllWithProgress(t *testing.T) {
+	input := strings.Repeat(fullRecord+otherRecord, 3)
+
+	calls := make([]int, 0)
+	var total uint64
+	records, err := NewReader(strings.NewReader(input), true).ReadAllWithProgress(2, func(count int, bytes uint64) {
+		calls = append(calls, count)
+		total = bytes
+	})
+	if err != nil || len(records) != 6 {
+		t.Fatalf("Expected 6 records, got %d: %v", len(records), err)
+	}
+	if len(calls) != 3 || calls[0] != 2 || calls[1] != 4 || calls[2] != 6 {
+		t.Errorf("Progress callbacks are wrong: %v", calls)
+	}
+	if total != uint64(len(input)) {
+		t.Errorf("Final byte count is %d, expected %d", total, len(input))
+	}
+
+	// a count that is not a multiple of every gets a final callback
+	calls = calls[:0]
+	NewReader(strings.NewReader(input), true).ReadAllWithProgress(4, func(count int, bytes uint64) {
+		calls = append(calls, count)
+	})
+	if len(calls) != 2 || calls[0] != 4 || calls[1] != 6 {
+		t.Errorf("Progress callbacks are wrong: %v", calls)
+	}
+
+	calls = calls[:0]
+	if records, _ := ReadAllWithProgress(strings.NewReader(input), func(count int, bytes uint64) {
+		calls = append(calls, count)
+	}); len(records) != 6 || len(calls) != 1 || calls[0] != 6 {
+		t.Errorf("Expected a single final callback, got %v", calls)
+	}
+}
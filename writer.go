@@ -0,0 +1,241 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"io"
+	"sort"
+	"time"
+)
+
+// A Writer writes records as ISO 2709 (Z39.2) binary MARC.
+type Writer struct {
+	w         io.Writer
+	separator []byte
+	dropEmpty bool
+	encoding  Encoding
+	timestamp bool
+	now       func() time.Time
+}
+
+// An Encoding is a character coding scheme, as recorded in the leader.
+type Encoding byte
+
+const (
+	MARC8 Encoding = ' '
+	UTF8  Encoding = 'a'
+)
+
+func NewWriter(w io.Writer) *Writer {
+	nw := new(Writer)
+	nw.w = w
+	nw.now = time.Now
+	return nw
+}
+
+// RecordSeparator sets bytes, such as "\n", to write after each record's
+// terminator. This is not standard MARC, and the separator is not counted in
+// the record length. By default no separator is written.
+func (w *Writer) RecordSeparator(sep []byte) {
+	w.separator = sep
+}
+
+// DropEmptyFields sets whether data fields without subfields and control
+// fields without a value are omitted from the written records. The records
+// themselves are not modified.
+func (w *Writer) DropEmptyFields(drop bool) {
+	w.dropEmpty = drop
+}
+
+// OutputEncoding sets the character encoding of the written records. Records
+// in another encoding are transcoded, and their leader positions 08 and 09
+// updated. MARC-8 output carries a 066 field listing any character sets used
+// beyond Basic Latin and ANSEL. By default records are written in the
+// encoding they were read in.
+func (w *Writer) OutputEncoding(e Encoding) {
+	w.encoding = e
+}
+
+// UpdateTimestamp sets whether modified records (see MarcRecord.Modified)
+// are written with their 005 set to the current time, as cataloging rules
+// require of a changed record. The 005 is added if missing; the records
+// themselves are not modified.
+func (w *Writer) UpdateTimestamp(update bool) {
+	w.timestamp = update
+}
+
+// Write writes a single record.
+func (w *Writer) Write(m *MarcRecord) error {
+	raw, err := w.encode(m)
+	if err != nil {
+		return err
+	}
+	if _, err := w.w.Write(raw); err != nil {
+		return err
+	}
+	if len(w.separator) > 0 {
+		if _, err := w.w.Write(w.separator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encode returns the bytes to write for m. A record whose fields and leader
+// structure are unchanged is written verbatim, including one patched in
+// place by SetStatus, unless one of the writer's options changes its
+// content; otherwise its leader and directory are recomputed.
+func (w *Writer) encode(m *MarcRecord) ([]byte, error) {
+	transcode := w.encoding != 0 && w.encoding != Encoding(m.CharacterEncoding)
+	timestamp := w.timestamp && m.modified
+	if !w.dropEmpty && !transcode && !timestamp && !m.dirty {
+		return m.RawRecord, nil
+	}
+
+	leader := m.RawRecord[:leaderSize]
+	fields := m.rawFields()
+	changed := transcode || timestamp || m.dirty
+	if transcode {
+		var err error
+		if leader, fields, err = transcodeFields(m, w.encoding); err != nil {
+			return nil, err
+		}
+	}
+
+	if timestamp {
+		fields = w.setTimestamp(fields)
+	}
+
+	if w.dropEmpty {
+		delims := m.delims
+		if transcode {
+			delims = delimiters{}
+		}
+		kept := make([]rawField, 0, len(fields))
+		for _, f := range fields {
+			if !isEmptyField(f, delims) {
+				kept = append(kept, f)
+			}
+		}
+		changed = changed || len(kept) != len(fields)
+		fields = kept
+	}
+
+	if !changed {
+		return m.RawRecord, nil
+	}
+	return encodeRecord(leader, fields)
+}
+
+// transcodeFields returns the leader and fields of m converted to the
+// encoding e.
+func transcodeFields(m *MarcRecord, e Encoding) ([]byte, []rawField, error) {
+	used := make(map[byte]bool)
+	convert := func(b []byte) ([]byte, error) {
+		s, err := m.decoder(b)
+		if err != nil {
+			return nil, err
+		}
+		if e == MARC8 {
+			return encodeMARC8(s, used)
+		}
+		return []byte(s), nil
+	}
+
+	// the fields are split on the record's delimiters and reencoded with the
+	// MARC 21 ones
+	_, ft := m.delims.get()
+	fields := make([]rawField, 0)
+	for _, f := range m.rawFields() {
+		if f.tag == "066" {
+			continue
+		}
+		// the data of a corrupt record may be too short for indicators or
+		// lack its terminator
+		raw := f.data
+		if len(raw) > 0 && raw[len(raw)-1] == ft {
+			raw = raw[:len(raw)-1]
+		}
+		if IsControlFieldTag(f.tag) {
+			value, err := convert(raw)
+			if err != nil {
+				return nil, nil, err
+			}
+			fields = append(fields, rawField{f.tag, append(value, fieldTerminator), f.impl})
+			continue
+		}
+		data := []byte{IndicatorBlank, IndicatorBlank}
+		copy(data, raw)
+		if len(raw) <= 2 {
+			fields = append(fields, rawField{f.tag, append(data, fieldTerminator), f.impl})
+			continue
+		}
+		for _, sf := range subfieldChunks(append(raw[2:len(raw):len(raw)], ft), m.delims) {
+			value, err := convert(sf[1:])
+			if err != nil {
+				return nil, nil, err
+			}
+			data = append(data, delimiter, sf[0])
+			data = append(data, value...)
+		}
+		fields = append(fields, rawField{f.tag, append(data, fieldTerminator), f.impl})
+	}
+
+	if len(used) > 0 {
+		sets := make([]string, 0, len(used))
+		for set := range used {
+			sets = append(sets, string(designateMARC8(set)[1:]))
+		}
+		sort.Strings(sets)
+		subfields := make([]Subfield, len(sets))
+		for i := range sets {
+			subfields[i] = Subfield{"c", sets[i]}
+		}
+		fields = insertOrdered(fields, rawField{tag: "066", data: encodeDataField(' ', ' ', subfields)})
+	}
+
+	leader := append([]byte(nil), m.RawRecord[:leaderSize]...)
+	leader[9] = byte(e)
+	return leader, fields, nil
+}
+
+// timestampLayout is the 005 format, yyyymmddhhmmss.f.
+const timestampLayout = "20060102150405.0"
+
+// setTimestamp returns fields with the 005 set to the current UTC time.
+func (w *Writer) setTimestamp(fields []rawField) []rawField {
+	ts := rawField{tag: "005", data: append([]byte(w.now().UTC().Format(timestampLayout)), fieldTerminator)}
+	updated := make([]rawField, len(fields))
+	copy(updated, fields)
+	for i := range updated {
+		if updated[i].tag == "005" {
+			ts.impl = updated[i].impl
+			updated[i] = ts
+			return updated
+		}
+	}
+	return insertOrdered(updated, ts)
+}
+
+// isEmptyField reports whether f holds no data: a control field with no
+// value, or a data field with no subfields, counting data not introduced by
+// a delimiter as an implicit $a. f is delimited by d.
+func isEmptyField(f rawField, d delimiters) bool {
+	if IsControlFieldTag(f.tag) {
+		return len(f.data) <= 1
+	}
+	_, ft := d.get()
+	return len(f.data) <= 2 || len(subfieldChunks(append(f.data[2:len(f.data):len(f.data)], ft), d)) == 0
+}
@@ -0,0 +1,328 @@
+// Copyright 2013-14 Thomas Emerson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package marc21
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriterRecordSeparator(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.RecordSeparator([]byte("\n"))
+	w.Write(m)
+	w.Write(m)
+
+	if buf.Len() != 2*(fullRecordLen+1) {
+		t.Errorf("Output should be two records and separators, got %d bytes", buf.Len())
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte(fullRecord+"\n")) {
+		t.Errorf("Record length or data changed by separator")
+	}
+
+	r := NewReader(&buf, true)
+	for i := 0; i < 2; i++ {
+		rec, err := r.Next()
+		if err != nil || rec == nil {
+			t.Fatalf("Unable to read record %d: %v", i, err)
+		}
+		if uint64(i*(fullRecordLen+1)) != rec.Offset {
+			t.Errorf("Record %d offset is wrong: %d", i, rec.Offset)
+		}
+	}
+	if rec, err := r.Next(); rec != nil || err != nil {
+		t.Errorf("Expected end of stream, got %v, %v", rec, err)
+	}
+}
+
+func TestWriterPreservesFieldOrder(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	fields := m.rawFields()
+	fields[0], fields[4] = fields[4], fields[0]
+	unsorted, _ := encodeRecord(m.RawRecord, fields)
+
+	m, err := NewReader(bytes.NewReader(unsorted), false).Next()
+	if err != nil {
+		t.Fatalf("Unable to read unsorted record: %v", err)
+	}
+	var buf bytes.Buffer
+	NewWriter(&buf).Write(m)
+	if !bytes.Equal(buf.Bytes(), unsorted) {
+		t.Errorf("Written record does not match the unsorted input")
+	}
+
+	m.Canonicalize()
+	buf.Reset()
+	NewWriter(&buf).Write(m)
+	if bytes.Equal(buf.Bytes(), unsorted) {
+		t.Errorf("Canonicalized record should be reordered")
+	}
+	if tag := m.rawFields()[0].tag; tag != "001" {
+		t.Errorf("First canonical field should be 001, got %v", tag)
+	}
+	if tag := m.rawFields()[10].tag; tag != "988" {
+		t.Errorf("Last canonical field should be 988, got %v", tag)
+	}
+}
+
+func TestWriterDropEmptyFields(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), false, 0)
+	if err := m.DeleteSubfields("650", "a"); err != nil {
+		t.Fatalf("Unable to delete subfields: %v", err)
+	}
+	if len(m.GetRawFieldData("650")) != 1 {
+		t.Fatalf("Emptied 650 should remain in the record")
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.DropEmptyFields(true)
+	w.Write(m)
+
+	written, err := NewMarcRecord(buf.Bytes(), true, 0)
+	if err != nil {
+		t.Fatalf("Written record does not parse: %v", err)
+	}
+	if len(written.GetRawFieldData("650")) != 0 {
+		t.Errorf("Empty 650 should have been dropped")
+	}
+	if len(written.GetFieldList()) != 10 {
+		t.Errorf("Only the empty field should be dropped")
+	}
+
+	// records without empty fields are written untouched
+	buf.Reset()
+	m, _ = NewMarcRecord([]byte(fullRecord), false, 0)
+	w.Write(m)
+	if buf.String() != fullRecord {
+		t.Errorf("Record without empty fields was changed")
+	}
+
+	// a 245 holding only an implicit $a is not empty, and a 260 cut short
+	// after its first indicator is left alone by DeleteSubfields
+	m, _ = NewMarcRecord([]byte(fullRecord), false, 0)
+	fields := m.rawFields()
+	fields[4].data = []byte("00Garden exhibition /\x1e")
+	fields[5].data = []byte("0")
+	m.setFields(fields)
+	if err := m.DeleteSubfields("260", "a"); err != nil {
+		t.Fatalf("Unable to delete subfields: %v", err)
+	}
+	buf.Reset()
+	w.Write(m)
+	written, err = NewMarcRecord(buf.Bytes(), false, 0)
+	if err != nil {
+		t.Fatalf("Written record does not parse: %v", err)
+	}
+	if v := written.GetSubfield("245", "a"); v != "Garden exhibition /" {
+		t.Errorf("245 with an implicit $a should be kept, got %q", v)
+	}
+}
+
+func TestWriterMARC8RoundTrip(t *testing.T) {
+	title := "Ομηρος : Café"
+	m, err := NewRecordBuilder().
+		AddControlField("001", "greek-2").
+		AddDataField("245", '1', '0', Subfield{"a", title}, Subfield{"c", "1937."}).
+		Build()
+	if err != nil {
+		t.Fatalf("Unable to build record: %v", err)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.OutputEncoding(MARC8)
+	if err := w.Write(m); err != nil {
+		t.Fatalf("Unable to write MARC-8 record: %v", err)
+	}
+
+	marc8, err := NewMarcRecord(buf.Bytes(), true, 0)
+	if err != nil {
+		t.Fatalf("MARC-8 record does not parse: %v", err)
+	}
+	if marc8.CharacterEncoding != ' ' {
+		t.Errorf("MARC-8 record should have a blank encoding, got %q", marc8.CharacterEncoding)
+	}
+	raw := marc8.GetRawField("245")
+	if !bytes.Contains(raw.GetRawValue(0), []byte("\x1b(S")) {
+		t.Errorf("Greek text should be introduced by an escape: %q", raw.GetRawValue(0))
+	}
+	sets := marc8.GetRawField("066")
+	if v := sets.GetNthSubfield("c", 0); v != "(S" {
+		t.Errorf("066$c should declare Greek, got %q", v)
+	}
+
+	// decoding recomposes the accented letter
+	want := title
+	if v := raw.GetNthSubfield("a", 0); v != want {
+		t.Errorf("MARC-8 245$a decodes to %q, want %q", v, want)
+	}
+
+	buf.Reset()
+	w.OutputEncoding(UTF8)
+	w.Write(marc8)
+	utf8, _ := NewMarcRecord(buf.Bytes(), true, 0)
+	field := utf8.GetRawField("245")
+	if v := field.GetNthSubfield("a", 0); v != want {
+		t.Errorf("Round-tripped 245$a is %q, want %q", v, want)
+	}
+	if len(utf8.GetRawFieldData("066")) != 0 {
+		t.Errorf("UTF-8 record should not carry a 066")
+	}
+}
+
+func TestWriterTranscodeCorruptFields(t *testing.T) {
+	// an archival control record (08 'a') with the 001 directory entry's
+	// length zeroed and a 245 cut short after its first indicator
+	corrupt := fullRecord[:8] + "a" + fullRecord[9:]
+	corrupt = strings.Replace(corrupt, "001001200000", "001000000000", 1)
+	corrupt = strings.Replace(corrupt, "245005400086", "245000100086", 1)
+	m, err := NewMarcRecord([]byte(corrupt), false, 0)
+	if err != nil {
+		t.Fatalf("Unable to parse record: %v", err)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.OutputEncoding(MARC8)
+	if err := w.Write(m); err != nil {
+		t.Fatalf("Unable to transcode record: %v", err)
+	}
+	written, err := NewMarcRecord(buf.Bytes(), true, 0)
+	if err != nil {
+		t.Fatalf("Transcoded record does not parse: %v", err)
+	}
+	if l := written.GetLeader(); l[8] != 'a' || l[9] != ' ' {
+		t.Errorf("Only the coding scheme should change: %q", l)
+	}
+	field := written.GetRawField("245")
+	if ind := field.GetIndicators(0); ind != "0#" {
+		t.Errorf("Short 245 should get blank indicators, got %q", ind)
+	}
+}
+
+func TestWriterPreservesControlFieldSpaces(t *testing.T) {
+	fixed := "821202s1937    cau           000 0 eng  "
+	built, _ := NewRecordBuilder().
+		AddControlField("001", "000000002-7").
+		AddControlField("008", fixed).
+		AddDataField("245", '0', '0', Subfield{"a", "Garden  exhibition"}).
+		Build()
+
+	// reading with collapsed whitespace and writing in another encoding
+	// decodes and reencodes every value
+	r := NewReader(bytes.NewReader(built.RawRecord), true)
+	r.CollapseWhitespace(true)
+	m, err := r.Next()
+	if err != nil {
+		t.Fatalf("Unable to read record: %v", err)
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.OutputEncoding(MARC8)
+	if err := w.Write(m); err != nil {
+		t.Fatalf("Unable to write record: %v", err)
+	}
+
+	m, err = NewReader(&buf, true).Next()
+	if err != nil {
+		t.Fatalf("Unable to read written record: %v", err)
+	}
+	if data := m.GetRawFieldData("008"); len(data) != 1 || string(data[0]) != fixed {
+		t.Errorf("008 did not survive the round trip: %q", data)
+	}
+	if raw := m.GetRawField("245"); string(raw.GetNthRawSubfield("a", 0)) != "Garden  exhibition" {
+		t.Errorf("245 $a did not survive the round trip")
+	}
+}
+
+func TestWriterDirtyRecords(t *testing.T) {
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+	if m.Modified() {
+		t.Errorf("Parsed record should not be modified")
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Write(m)
+	if buf.String() != fullRecord {
+		t.Errorf("Unmodified record was not written verbatim")
+	}
+
+	m.AddControlField("003", "DLC")
+	if !m.Modified() {
+		t.Errorf("Record should be modified after AddControlField")
+	}
+
+	// SetStatus edits RawRecord in place, so the record is modified but
+	// written verbatim, keeping a layout with data out of directory order
+	swapped := strings.Replace(fullRecord, "001001200000005001700012", "005001700012001001200000", 1)
+	m, _ = NewMarcRecord([]byte(swapped), true, 0)
+	m.SetStatus('c')
+	if !m.Modified() {
+		t.Errorf("Record should be modified after SetStatus")
+	}
+	buf.Reset()
+	w.Write(m)
+	if buf.String() != swapped[:5]+"c"+swapped[6:] {
+		t.Errorf("Record with a new status should be written verbatim:\n%q", buf.String())
+	}
+
+	// but a writer updating timestamps reserializes it with a new 005
+	w.UpdateTimestamp(true)
+	w.now = func() time.Time { return time.Date(2026, 10, 14, 9, 30, 5, 0, time.UTC) }
+	buf.Reset()
+	w.Write(m)
+	written, err := NewMarcRecord(buf.Bytes(), true, 0)
+	if err != nil {
+		t.Fatalf("Modified record does not parse: %v", err)
+	}
+	if ts, _ := written.GetControlField("005"); ts != "20261014093005.0" || written.Status != 'c' {
+		t.Errorf("Record with a new status should get a new 005, got %q", ts)
+	}
+}
+
+func TestWriterUpdateTimestamp(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.UpdateTimestamp(true)
+	w.now = func() time.Time { return time.Date(2026, 10, 14, 9, 30, 5, 0, time.UTC) }
+
+	m, _ := NewMarcRecord([]byte(fullRecord), true, 0)
+	w.Write(m)
+	if buf.String() != fullRecord {
+		t.Errorf("Unmodified record's 005 should be preserved")
+	}
+
+	m.AddDataField("500", ' ', ' ', Subfield{"a", "Exhibition leaflet."})
+	buf.Reset()
+	w.Write(m)
+	written, err := NewMarcRecord(buf.Bytes(), true, 0)
+	if err != nil {
+		t.Fatalf("Written record does not parse: %v", err)
+	}
+	if ts, _ := written.GetControlField("005"); ts != "20261014093005.0" {
+		t.Errorf("005 was not updated: %q", ts)
+	}
+	if ts, _ := m.GetControlField("005"); ts != "20120831093346.0" {
+		t.Errorf("Record itself should not be changed: %q", ts)
+	}
+}